@@ -520,6 +520,7 @@ func (c *Client) mapRoutine() {
 			c.mu.Lock()
 			c.inPollNetMap = false
 			c.mu.Unlock()
+			health.SetInPollNetMap(false)
 
 			err := c.direct.PollNetMap(ctx, -1, func(nm *netmap.NetworkMap) {
 				c.mu.Lock()
@@ -538,6 +539,7 @@ func (c *Client) mapRoutine() {
 
 				c.synced = true
 				c.inPollNetMap = true
+				health.SetInPollNetMap(true)
 				if c.loggedIn {
 					c.state = StateSynchronized
 				}
@@ -562,6 +564,12 @@ func (c *Client) mapRoutine() {
 			}
 			paused := c.paused
 			c.mu.Unlock()
+			pollErr := err
+			if ctx.Err() != nil {
+				// Canceled on purpose, not a control connection problem.
+				pollErr = nil
+			}
+			health.SetInPollNetMapReason(false, pollErr)
 
 			if paused {
 				c.logf("mapRoutine: paused")
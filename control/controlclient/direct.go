@@ -396,6 +396,7 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 		}
 		c.logf("server reports new node key %v has expired",
 			request.NodeKey.ShortString())
+		health.SetNodeExpired(true)
 		return true, "", nil
 	}
 	if persist.Provider == "" {
@@ -421,6 +422,7 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 	if resp.AuthURL == "" {
 		// key rotation is complete
 		persist.PrivateNodeKey = tryingNewKey
+		health.SetNodeExpired(false)
 	} else {
 		// save it for the retry-with-URL
 		c.tryingNewKey = tryingNewKey
@@ -596,6 +598,8 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 	}
 	defer res.Body.Close()
 
+	health.NoteMapRequestHeard(&request)
+
 	if cb == nil {
 		io.Copy(ioutil.Discard, res.Body)
 		return nil
@@ -669,6 +673,8 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 			return err
 		}
 
+		health.GotStreamedMapResponse()
+
 		if resp.KeepAlive {
 			vlogf("netmap: got keep-alive")
 		} else {
@@ -7,31 +7,626 @@
 package health
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
 )
 
 var (
 	mu       sync.Mutex
-	m        = map[string]error{}                     // error key => err (or nil for no error)
-	watchers = map[*watchHandle]func(string, error){} // opt func to run if error state changes
+	m        = map[string]*entry{} // error key => state
+	watchers = map[*watcher]bool{} // opt funcs to run if error state changes
+	info     = map[string]string{} // informational key => value; never an error
+
+	overallWatchers = map[*watcher]bool{} // opt funcs to run if OverallError changes nil-ness
+
+	pauses        int                  // number of Pause calls not yet resumed
+	pausedFrom    map[string]pausedKey // while paused: key => its state before its first transition in the pause
+	pausedHealthy bool                 // while paused: whether overall health was healthy when the first Pause was called
+
+	checks        = map[string]*check{} // error key => func polled to set it
+	checkLoopOnce sync.Once
+
+	healthyTTL time.Duration // if non-zero, how long healthy keys are kept without being set
+
+	escalateAfter = map[string]time.Duration{} // warning key => how long it can stay set before it's an error
+
+	causes []error // sentinel errors registered with RegisterCause
+
+	inMapPoll               bool
+	inMapPollSince          time.Time
+	lastStreamedMapResponse time.Time
+	lastMapRequestHeard     time.Time // only non-zero if we've heard back from control
+
+	keyExpiry time.Time // when the node key expires, or zero if it doesn't
+
+	hadPeers bool // whether SetPeerCount has ever been given a nonzero count
+
+	sleeping  bool                 // between NoteSleep and NoteResume
+	resumedAt time.Time            // last NoteResume, while in its grace period; else zero
+	held      map[string]pausedKey // connectivity errors held back while sleeping or resuming
+
+	mapPollStaleAfter = defaultMapPollStaleAfter // see SetMapResponseStaleThreshold
+
+	derpHomeRegion      int                       // magicsock's home DERP region, or 0 if none
+	advertisedDERPHome  int                       // PreferredDERP in the last map request control accepted, or 0
+	derpLatency         = map[int]time.Duration{} // DERP region ID => moving average of latency
+	derpRegionConnected = map[int]time.Time{}     // DERP region ID => since when magicsock has been connected to it, if it is
+
+	recent     [maxRecentTransitions]HealthEvent // ring of the latest transitions; see RecentTransitions
+	recentNext int                               // index in recent of the next event to record
+	recentLen  int                               // number of events in recent
+
+	timeNow   = time.Now   // for tests
+	timeSleep = time.Sleep // for tests
+)
+
+// entry is the state of a single error key.
+type entry struct {
+	err     error     // or nil for no error
+	sev     Severity  // severity of err, if non-nil
+	hint    string    // how to fix err, if known; see SetWithHint
+	lastSet time.Time // last time set was called for the key
+	changed time.Time // last time err went from nil to non-nil or back
+
+	firstHealthy time.Time // first time err was nil, or zero if never
+	escalated    bool      // err was promoted from a warning by SetEscalation
+	transient    bool      // err was set by SetTransient
+}
+
+// pausedKey is the state of a key before it first changed during a
+// Pause, or an error held back after NoteSleep or NoteResume along
+// with the attributes its setter attached to it.
+type pausedKey struct {
+	err       error
+	sev       Severity
+	hint      string // for held errors; see setAttrsLocked
+	transient bool   // for held errors; see setAttrsLocked
+}
+
+// Pause holds back all watcher notifications until resume is called,
+// for bulk operations like a full reconfigure that would otherwise
+// cause a storm of them. On resume, each watcher is notified at most
+// once per key, of the net change over the pause, and overall watchers
+// at most once; a key that went unhealthy and back is not reported
+// at all. Health state itself is updated as usual while paused.
+//
+// Pauses nest: notifications resume when all have been resumed.
+// Calling resume more than once has no further effect.
+func Pause() (resume func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	if pauses == 0 {
+		pausedFrom = map[string]pausedKey{}
+		pausedHealthy = overallHealthyLocked()
+	}
+	pauses++
+	var once sync.Once
+	return func() { once.Do(resumeOne) }
+}
+
+// resumeOne undoes one Pause, delivering the held-back notifications
+// if it was the last.
+func resumeOne() {
+	mu.Lock()
+	defer mu.Unlock()
+	pauses--
+	if pauses > 0 {
+		return
+	}
+	keys := make([]string, 0, len(pausedFrom))
+	for key := range pausedFrom {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		from := pausedFrom[key]
+		var cur error
+		sev := from.sev
+		if e, ok := m[key]; ok {
+			cur, sev = e.err, e.sev
+		}
+		queueTransitionLocked(key, sev, from.err, cur)
+	}
+	pausedFrom = nil
+	notifyOverallLocked(pausedHealthy)
+}
+
+// maxRecentTransitions is how many transitions RecentTransitions
+// keeps.
+const maxRecentTransitions = 100
+
+// HealthEvent is a change of an error key between healthy and
+// unhealthy, as kept for RecentTransitions.
+type HealthEvent struct {
+	When     time.Time
+	Key      string
+	Severity Severity // of the error set, or of the one cleared
+	Err      error    // the new error, or nil if the key became healthy
+}
+
+// RecentTransitions returns the latest transitions of all error keys,
+// oldest first, up to the last 100. It's a compact timeline for bug
+// reports without needing verbose logging on. Reset doesn't clear it.
+func RecentTransitions() []HealthEvent {
+	mu.Lock()
+	defer mu.Unlock()
+	ret := make([]HealthEvent, 0, recentLen)
+	start := recentNext - recentLen
+	if start < 0 {
+		start += maxRecentTransitions
+	}
+	for i := 0; i < recentLen; i++ {
+		ret = append(ret, recent[(start+i)%maxRecentTransitions])
+	}
+	return ret
+}
+
+// recordTransitionLocked adds ev to the RecentTransitions ring.
+//
+// mu must be held.
+func recordTransitionLocked(ev HealthEvent) {
+	recent[recentNext] = ev
+	recentNext = (recentNext + 1) % maxRecentTransitions
+	if recentLen < maxRecentTransitions {
+		recentLen++
+	}
+}
+
+// Severity is how serious an unhealthy key is.
+type Severity int
+
+const (
+	// SeverityWarning is for problems that degrade the node but
+	// don't break it, like slow reconfiguration.
+	SeverityWarning Severity = iota + 1
+	// SeverityError is for problems that break connectivity. It's
+	// the severity of errors reported without an explicit one.
+	SeverityError
+	// SeverityPermanent is for errors that won't clear up without the
+	// user's help, like missing permissions. Subsystems use it once
+	// they've retried for a while without success.
+	SeverityPermanent
 )
 
-type watchHandle byte
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	case SeverityPermanent:
+		return "permanent"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// watcher is a registered watcher callback and its queue of
+// transitions not yet delivered.
+type watcher struct {
+	cb       func(transition)
+	minSev   Severity      // transitions of keys less severe than this are skipped
+	interval time.Duration // if non-zero, the minimum time between deliveries
+	key      string        // if non-empty, the only key whose transitions are delivered
+	once     bool          // unregister after the first transition is queued
+
+	// Guarded by mu:
+	unhealthy map[string]bool // if minSev is set: keys w was last told are unhealthy
+	pending   []transition
+	running   bool      // whether a run goroutine is delivering pending
+	delivered time.Time // when pending was last delivered, if interval is set
+}
+
+// transition is a change of a key between healthy and unhealthy. For
+// overall watchers, key is empty and the errors are OverallError's.
+type transition struct {
+	key            string
+	oldErr, newErr error
+}
+
+// enqueueLocked queues t for delivery to w, starting a goroutine to
+// deliver it if one isn't already running. Each watcher has at most
+// one such goroutine, so it sees transitions in the order they
+// happened and can't be overrun with goroutines.
+//
+// mu must be held.
+func (w *watcher) enqueueLocked(t transition) {
+	w.pending = append(w.pending, t)
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+}
+
+func (w *watcher) run() {
+	for {
+		mu.Lock()
+		if len(w.pending) == 0 {
+			w.running = false
+			mu.Unlock()
+			return
+		}
+		if w.interval > 0 {
+			if wait := w.delivered.Add(w.interval).Sub(timeNow()); wait > 0 {
+				mu.Unlock()
+				timeSleep(wait)
+				continue
+			}
+			ts := coalesceTransitions(w.pending)
+			w.pending = nil
+			w.delivered = timeNow()
+			mu.Unlock()
+
+			for _, t := range ts {
+				w.cb(t)
+			}
+			continue
+		}
+		t := w.pending[0]
+		w.pending[0] = transition{}
+		w.pending = w.pending[1:]
+		mu.Unlock()
+
+		w.cb(t)
+	}
+}
 
 // RegisterWatcher adds a function that will be called if an
 // error changes state either to unhealthy or from unhealthy. It is
 // not called on transition from unknown to healthy. It must be non-nil
-// and is run in its own goroutine. The returned func unregisters it.
+// and is run in its own goroutine, never concurrently with itself, and
+// sees transitions in the order they happened. The returned func
+// unregisters it.
 func RegisterWatcher(cb func(errKey string, err error)) (unregister func()) {
+	return RegisterTransitionWatcher(func(errKey string, _, newErr error) {
+		cb(errKey, newErr)
+	})
+}
+
+// RegisterTransitionWatcher is like RegisterWatcher, but cb is also
+// given the key's error before the change (nil if it was healthy or
+// unknown), so it can tell which way the key transitioned.
+func RegisterTransitionWatcher(cb func(errKey string, oldErr, newErr error)) (unregister func()) {
+	w := &watcher{cb: func(t transition) { cb(t.key, t.oldErr, t.newErr) }}
+	return registerLocked(watchers, w)
+}
+
+// RegisterSeverityWatcher is like RegisterTransitionWatcher, but cb
+// only sees keys as unhealthy while their error is at least as severe
+// as min. A key whose error crosses min without becoming healthy, such
+// as a warning escalated to an error or an error downgraded to a
+// warning, is reported to cb as becoming unhealthy (with a nil oldErr)
+// or healthy (with a nil newErr). A key becoming healthy is reported
+// only if cb was last told it was unhealthy. For instance, alerting
+// can pass SeverityError to ignore warnings, which never even get
+// queued for it.
+func RegisterSeverityWatcher(min Severity, cb func(errKey string, oldErr, newErr error)) (unregister func()) {
+	w := &watcher{
+		cb:     func(t transition) { cb(t.key, t.oldErr, t.newErr) },
+		minSev: min,
+	}
+	return registerLocked(watchers, w)
+}
+
+// RegisterOnce registers cb to be called with the key's new error (nil
+// if it became healthy) on its next transition only. It's then
+// unregistered; the returned func unregisters it if that hasn't
+// happened yet.
+func RegisterOnce(key string, cb func(err error)) (unregister func()) {
+	w := &watcher{
+		cb:   func(t transition) { cb(t.newErr) },
+		key:  key,
+		once: true,
+	}
+	return registerLocked(watchers, w)
+}
+
+// RegisterThrottledWatcher is like RegisterTransitionWatcher, but cb
+// is called in bursts at most once per interval, for consumers too slow
+// to keep up with every transition. Transitions that arrive in between
+// are coalesced into one per key, from its state before the first to
+// its state after the last; a key that ends up healthy again is
+// dropped.
+func RegisterThrottledWatcher(interval time.Duration, cb func(errKey string, oldErr, newErr error)) (unregister func()) {
+	w := &watcher{
+		cb:       func(t transition) { cb(t.key, t.oldErr, t.newErr) },
+		interval: interval,
+	}
+	return registerLocked(watchers, w)
+}
+
+// coalesceTransitions merges ts into at most one transition per key,
+// in the order the keys first appear, dropping keys that were healthy
+// both before and after.
+func coalesceTransitions(ts []transition) []transition {
+	var ret []transition
+	index := map[string]int{} // key => index in ret
+	for _, t := range ts {
+		if i, ok := index[t.key]; ok {
+			ret[i].newErr = t.newErr
+			continue
+		}
+		index[t.key] = len(ret)
+		ret = append(ret, t)
+	}
+	n := 0
+	for _, t := range ret {
+		if t.oldErr != nil || t.newErr != nil {
+			ret[n] = t
+			n++
+		}
+	}
+	return ret[:n]
+}
+
+// RegisterOverallWatcher adds a function that will be called when
+// OverallError changes from nil to non-nil or back, with whether the
+// node is now healthy. It's run the same way as RegisterWatcher's
+// callbacks. The returned func unregisters it.
+func RegisterOverallWatcher(cb func(healthy bool)) (unregister func()) {
+	w := &watcher{cb: func(t transition) { cb(t.newErr == nil) }}
+	return registerLocked(overallWatchers, w)
+}
+
+// registerLocked adds w to set, returning a func to remove it.
+func registerLocked(set map[*watcher]bool, w *watcher) (unregister func()) {
 	mu.Lock()
 	defer mu.Unlock()
-	handle := new(watchHandle)
-	watchers[handle] = cb
+	set[w] = true
+	if w.minSev > 0 {
+		for key, e := range m {
+			if e.err != nil && e.sev >= w.minSev && (w.key == "" || w.key == key) {
+				if w.unhealthy == nil {
+					w.unhealthy = map[string]bool{}
+				}
+				w.unhealthy[key] = true
+			}
+		}
+	}
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(set, w)
+		w.pending = nil
+	}
+}
+
+// check is a registered func polled by RunChecks.
+type check struct {
+	fn  func() error
+	sev Severity
+}
+
+// checkInterval is how often registered checks are run in the
+// background.
+const checkInterval = time.Minute
+
+// RegisterCheck registers check to be polled for the state of the
+// error key, for conditions that are more naturally checked than
+// pushed, like whether a well-known name resolves. Checks run
+// periodically in the background and whenever RunChecks is called,
+// and their result is stored as if passed to a setter for key.
+// Registering a check for a key that already has one replaces it.
+// The returned func unregisters it.
+func RegisterCheck(key string, fn func() error) (unregister func()) {
+	return registerCheck(key, fn, SeverityError)
+}
+
+// registerCheck is RegisterCheck with errors from fn stored with
+// severity sev.
+func registerCheck(key string, fn func() error, sev Severity) (unregister func()) {
+	c := &check{fn: fn, sev: sev}
+	mu.Lock()
+	checks[key] = c
+	mu.Unlock()
+	checkLoopOnce.Do(func() { go checkLoop() })
 	return func() {
 		mu.Lock()
 		defer mu.Unlock()
-		delete(watchers, handle)
+		if checks[key] == c {
+			delete(checks, key)
+		}
+	}
+}
+
+// RunChecks runs all registered checks now and stores their results.
+// Checks are run without holding any locks, one after another. It
+// also re-evaluates time-based state like key expiry.
+func RunChecks() {
+	mu.Lock()
+	keys := make([]string, 0, len(checks))
+	cs := make([]*check, 0, len(checks))
+	for k, c := range checks {
+		keys = append(keys, k)
+		cs = append(cs, c)
+	}
+	mu.Unlock()
+
+	for i, c := range cs {
+		setSeverity(keys[i], c.fn(), c.sev)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	updateKeyExpiryLocked()
+	updateMapResponseLocked()
+	escalateLocked(timeNow())
+	expireTransientLocked(timeNow())
+	endResumeGraceLocked(timeNow())
+	evictHealthyLocked(timeNow())
+}
+
+// RegisterCause registers cause, a sentinel error, as one that
+// identifies an error regardless of how it's wrapped. A key set again
+// with an error that wraps the same registered cause as its current
+// one, per errors.Is, keeps the current one, as if the two read the
+// same. That way a subsystem that adds varying context when it
+// re-wraps an error doesn't churn its health state.
+func RegisterCause(cause error) {
+	mu.Lock()
+	defer mu.Unlock()
+	causes = append(causes, cause)
+}
+
+// sameErrorLocked reports whether a and b, both non-nil, read the
+// same or wrap the same registered cause.
+//
+// mu must be held.
+func sameErrorLocked(a, b error) bool {
+	if a.Error() == b.Error() {
+		return true
+	}
+	for _, c := range causes {
+		if errors.Is(a, c) && errors.Is(b, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetEscalation sets how long the warning for key can stay set before
+// it's promoted to an error, for warnings that are usually transient
+// but mean something is stuck when they aren't. The promotion happens
+// on the periodic check after the warning has been unhealthy for
+// after, and lasts until the key is healthy again, even if it's set
+// again as a warning in the meantime. A non-positive after removes
+// the policy.
+func SetEscalation(key string, after time.Duration) {
+	mu.Lock()
+	if after <= 0 {
+		delete(escalateAfter, key)
+	} else {
+		escalateAfter[key] = after
+	}
+	mu.Unlock()
+	checkLoopOnce.Do(func() { go checkLoop() })
+}
+
+// escalateLocked promotes the warnings that have been set for longer
+// than their SetEscalation policy allows to errors.
+//
+// Key watchers that skip warnings see the promotion as the key
+// becoming unhealthy; the others, which already saw the warning, as a
+// transition whose old and new errors are the same. Outside of a
+// Pause, that is: promotions during one are only reflected in the
+// overall watchers and, on resume, the severity watchers.
+//
+// mu must be held.
+func escalateLocked(now time.Time) {
+	wasHealthy := overallHealthyLocked()
+	for key, after := range escalateAfter {
+		e, ok := m[key]
+		if !ok || e.err == nil || e.sev != SeverityWarning || now.Sub(e.changed) < after {
+			continue
+		}
+		e.sev = SeverityError
+		e.escalated = true
+		recordTransitionLocked(HealthEvent{When: now, Key: key, Severity: e.sev, Err: e.err})
+		if pauses > 0 {
+			if _, ok := pausedFrom[key]; !ok {
+				pausedFrom[key] = pausedKey{err: e.err, sev: SeverityWarning}
+			}
+			continue
+		}
+		for w := range watchers {
+			if w.key != "" && w.key != key {
+				continue
+			}
+			t, ok := transition{key, e.err, e.err}, true
+			if w.minSev > SeverityWarning {
+				t, ok = w.transitionLocked(key, e.sev, e.err, e.err)
+			}
+			if !ok {
+				continue
+			}
+			w.enqueueLocked(t)
+			if w.once {
+				delete(watchers, w)
+			}
+		}
+	}
+	notifyOverallLocked(wasHealthy)
+}
+
+func checkLoop() {
+	t := time.NewTicker(checkInterval)
+	defer t.Stop()
+	for range t.C {
+		RunChecks()
+	}
+}
+
+// SetInfo sets an informational entry describing the node's
+// environment, such as which backend a subsystem uses. Informational
+// entries are kept separately from error keys and never affect
+// health. An empty value removes the entry.
+func SetInfo(key, value string) {
+	mu.Lock()
+	defer mu.Unlock()
+	setInfoLocked(key, value)
+}
+
+func setInfoLocked(key, value string) {
+	if value == "" {
+		delete(info, key)
+		return
+	}
+	info[key] = value
+}
+
+// SetExitNode records the exit node in use, by display name and stable
+// node ID, as the "exit-node" and "exit-node-id" informational entries,
+// so a status UI can remind users their traffic goes through it. Empty
+// strings mean no exit node.
+func SetExitNode(name, id string) {
+	mu.Lock()
+	defer mu.Unlock()
+	setInfoLocked("exit-node", name)
+	setInfoLocked("exit-node-id", id)
+}
+
+// SetTailnet records the name of the tailnet the node is logged into
+// as the "tailnet" informational entry, or removes it if name is empty
+// because the node is logged out.
+func SetTailnet(name string) { SetInfo("tailnet", name) }
+
+// SetUpdateAvailable records the running client version and the
+// latest one available. When they differ, the latest is recorded as
+// the "update-available" informational entry and the
+// "update-available" warning is set, so status views show it with
+// the rest of the node's health. Both are cleared when current equals
+// latest, or latest is empty because it isn't known.
+func SetUpdateAvailable(current, latest string) {
+	mu.Lock()
+	defer mu.Unlock()
+	const key = "update-available"
+	if latest == "" || current == latest {
+		setInfoLocked(key, "")
+		if e, ok := m[key]; ok && e.err != nil {
+			setLocked(key, nil, SeverityWarning)
+		}
+		return
+	}
+	setInfoLocked(key, latest)
+	setLocked(key, fmt.Errorf("running version %s; version %s is available", current, latest), SeverityWarning)
+}
+
+// Info returns a copy of all informational entries set by SetInfo.
+func Info() map[string]string {
+	mu.Lock()
+	defer mu.Unlock()
+	ret := make(map[string]string, len(info))
+	for k, v := range info {
+		ret[k] = v
 	}
+	return ret
 }
 
 // SetRouter sets the state of the wgengine/router.Router.
@@ -40,32 +635,1372 @@ func SetRouterHealth(err error) { set("router", err) }
 // RouterHealth returns the wgengine/router.Router error state.
 func RouterHealth() error { return get("router") }
 
-func get(key string) error {
+// SetRouteMonitorHealth sets the state of monitoring the OS's
+// default routes, used by the router to follow MTU changes.
+func SetRouteMonitorHealth(err error) { set("route-monitor", err) }
+
+// RouteMonitorHealth returns the route monitoring error state.
+func RouteMonitorHealth() error { return get("route-monitor") }
+
+// SetTUNHealth sets whether the router's TUN interface still exists.
+func SetTUNHealth(err error) { set("tun-missing", err) }
+
+// TUNHealth returns the TUN interface error state.
+func TUNHealth() error { return get("tun-missing") }
+
+// RegisterTUNCheck registers check to be polled for the TUN
+// interface's state, as with RegisterCheck.
+func RegisterTUNCheck(check func() error) (unregister func()) {
+	return RegisterCheck("tun-missing", check)
+}
+
+// SetTUNDownHealth sets whether the router's TUN interface is
+// configured but not operationally up.
+func SetTUNDownHealth(err error) { set("tun-down", err) }
+
+// TUNDownHealth returns the TUN interface's link error state.
+func TUNDownHealth() error { return get("tun-down") }
+
+// RegisterTUNDownCheck registers check to be polled for the TUN
+// interface's link state, as with RegisterCheck.
+func RegisterTUNDownCheck(check func() error) (unregister func()) {
+	return RegisterCheck("tun-down", check)
+}
+
+// SetIPv6DisabledHealth sets whether the router had to skip the IPv6
+// part of its config because IPv6 is disabled on the host.
+func SetIPv6DisabledHealth(err error) { set("ipv6-disabled", err) }
+
+// IPv6DisabledHealth returns the error state of the router's IPv6
+// config.
+func IPv6DisabledHealth() error { return get("ipv6-disabled") }
+
+// SetDNSTimeoutHealth sets whether the router gave up on a hung
+// change of the OS DNS config.
+func SetDNSTimeoutHealth(err error) { set("dns-timeout", err) }
+
+// DNSTimeoutHealth returns the error state of the OS DNS config
+// changes.
+func DNSTimeoutHealth() error { return get("dns-timeout") }
+
+// SetMagicDNSHealth sets whether the MagicDNS resolver is answering
+// queries, as opposed to merely being configured.
+func SetMagicDNSHealth(err error) { set("magicdns", err) }
+
+// MagicDNSHealth returns the MagicDNS resolver error state.
+func MagicDNSHealth() error { return get("magicdns") }
+
+// RegisterMagicDNSCheck registers check to be polled for whether the
+// MagicDNS resolver is answering, as with RegisterCheck.
+func RegisterMagicDNSCheck(check func() error) (unregister func()) {
+	return RegisterCheck("magicdns", check)
+}
+
+// SetDNSUpstreamWarning sets or clears the warning that upstream DNS
+// servers aren't reachable.
+func SetDNSUpstreamWarning(err error) { setSeverity("dns-upstream", err, SeverityWarning) }
+
+// DNSUpstreamHealth returns the warning, if any, that upstream DNS
+// servers aren't reachable.
+func DNSUpstreamHealth() error { return get("dns-upstream") }
+
+// RegisterDNSUpstreamCheck registers check to be polled for whether
+// the configured upstream DNS servers are reachable, as with
+// RegisterCheck. Its errors are warnings.
+func RegisterDNSUpstreamCheck(check func() error) (unregister func()) {
+	return registerCheck("dns-upstream", check, SeverityWarning)
+}
+
+// SetDNSOverriddenWarning sets or clears the warning that another
+// program changed the OS DNS settings Tailscale applied.
+func SetDNSOverriddenWarning(err error) { setSeverity("dns-overridden", err, SeverityWarning) }
+
+// RegisterDNSOverriddenCheck registers check to be polled for whether
+// the OS DNS settings were changed by another program, as with
+// RegisterCheck. Its errors are warnings.
+func RegisterDNSOverriddenCheck(check func() error) (unregister func()) {
+	return registerCheck("dns-overridden", check, SeverityWarning)
+}
+
+// SetDNSSplitWithoutMagicDNSWarning sets or clears the warning that
+// split DNS routes are configured while MagicDNS, which they need, is
+// disabled.
+func SetDNSSplitWithoutMagicDNSWarning(err error) {
+	setSeverity("dns-split-without-magicdns", err, SeverityWarning)
+}
+
+// SetDefaultRouteHealth sets whether the OS has a default route
+// outside the Tailscale interface. Without one, the machine is
+// offline.
+func SetDefaultRouteHealth(err error) { set("no-default-route", err) }
+
+// DefaultRouteHealth returns the default route error state.
+func DefaultRouteHealth() error { return get("no-default-route") }
+
+// SetPMTUBlackholeWarning sets whether full-size packets are being
+// silently dropped on the path out, which makes large transfers stall.
+func SetPMTUBlackholeWarning(err error) {
+	setSeverity("pmtu-blackhole", err, SeverityWarning)
+}
+
+// RegisterPMTUBlackholeCheck registers check to be polled for whether
+// there's a path MTU black hole, as with RegisterCheck. Its errors are
+// warnings.
+func RegisterPMTUBlackholeCheck(check func() error) (unregister func()) {
+	return registerCheck("pmtu-blackhole", check, SeverityWarning)
+}
+
+// SetStateStoreHealth sets the state of persisting tailscaled's state
+// to disk. While it's failing, changes are lost on restart.
+func SetStateStoreHealth(err error) { set("state-store", err) }
+
+// StateStoreHealth returns the state store error state.
+func StateStoreHealth() error { return get("state-store") }
+
+// SetLocalAPIHealth sets the state of tailscaled's local API listener,
+// which the CLI and GUI use to talk to it. Its errors are mostly for
+// logs and in-process watchers, as clients can't reach a broken
+// listener to read them.
+func SetLocalAPIHealth(err error) { set("localapi", err) }
+
+// LocalAPIHealth returns the local API listener error state.
+func LocalAPIHealth() error { return get("localapi") }
+
+// resumeGracePeriod is how long after NoteResume connectivity errors
+// are held back, while the network comes back up.
+const resumeGracePeriod = 30 * time.Second
+
+// connectivityKeys are the keys that routinely go unhealthy around
+// sleep and resume, before the network is back.
+var connectivityKeys = map[string]bool{
+	"map-poll":         true,
+	"map-response":     true,
+	"no-default-route": true,
+	"captive-portal":   true,
+	"magicdns":         true,
+	"dns-upstream":     true,
+	"derp-home":        true,
+	"derp-latency":     true,
+}
+
+// NoteSleep notes that the system is going to sleep. Until
+// resumeGracePeriod after the following NoteResume, connectivity
+// errors aren't reported: the "power" informational entry says
+// "sleeping", then "resuming", instead. Errors that are still set at
+// the end of the grace period are reported then.
+func NoteSleep() {
 	mu.Lock()
 	defer mu.Unlock()
-	return m[key]
+	sleeping = true
+	resumedAt = time.Time{}
+	setInfoLocked("power", "sleeping")
 }
 
-func set(key string, err error) {
+// NoteResume notes that the system has resumed from sleep, starting
+// the grace period described at NoteSleep. It can be called without a
+// NoteSleep, if only the resume was seen.
+func NoteResume() {
 	mu.Lock()
 	defer mu.Unlock()
-	old, ok := m[key]
-	if !ok && err == nil {
-		// Initial happy path.
-		m[key] = nil
+	sleeping = false
+	resumedAt = timeNow()
+	setInfoLocked("power", "resuming")
+	time.AfterFunc(resumeGracePeriod, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		endResumeGraceLocked(timeNow())
+	})
+}
+
+// endResumeGraceLocked ends the grace period after NoteResume if it
+// has passed as of now, reporting the errors held back during it.
+//
+// mu must be held.
+func endResumeGraceLocked(now time.Time) {
+	if resumedAt.IsZero() || now.Sub(resumedAt) < resumeGracePeriod {
 		return
 	}
-	if ok && (old == nil) == (err == nil) {
-		// No change in overall error status (nil-vs-not), so
-		// don't run callbacks, but exact error might've
-		// changed, so note it.
-		if err != nil {
-			m[key] = err
+	resumedAt = time.Time{}
+	setInfoLocked("power", "")
+	keys := make([]string, 0, len(held))
+	for key := range held {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	wasHealthy := overallHealthyLocked()
+	for _, key := range keys {
+		h := held[key]
+		updateLocked(key, h.err, h.sev, now)
+		applyAttrsLocked(key, h.hint, h.transient)
+	}
+	held = nil
+	notifyOverallLocked(wasHealthy)
+}
+
+// SetCaptivePortal sets whether a captive portal was detected between
+// the node and the internet. It's cleared automatically once control
+// is reachable again.
+func SetCaptivePortal(detected bool) {
+	var err error
+	if detected {
+		err = errors.New("captive portal detected; sign in to the network in a browser")
+	}
+	setSeverity("captive-portal", err, SeverityWarning)
+}
+
+// SetRouteConflictWarning sets or clears the warning that routes
+// from control overlap subnets the host is directly attached to.
+func SetRouteConflictWarning(err error) { setSeverity("route-conflict", err, SeverityWarning) }
+
+// RouteConflictWarning returns the route conflict warning state.
+func RouteConflictWarning() error { return get("route-conflict") }
+
+// SetFirewallSlowWarning sets or clears the warning that reconfiguring
+// the OS firewall is unusually slow on this host.
+func SetFirewallSlowWarning(err error) { setSeverity("firewall-slow", err, SeverityWarning) }
+
+// SetPermanent sets the state of the error key to err with
+// SeverityPermanent, meaning it requires action from the user rather
+// than more retries. A nil err clears it, like any other setter.
+func SetPermanent(key string, err error) { setSeverity(key, err, SeverityPermanent) }
+
+// transientTTL is how long an error set by SetTransient lasts if it
+// isn't set again.
+const transientTTL = 2 * time.Minute
+
+// SetTransient sets the state of the error key to err as a transient
+// warning: one expected to go away on its own, like a brief DERP
+// outage, that UIs should show subtly rather than alarm about. Unless
+// it's set again, it's cleared on the first periodic check at least
+// transientTTL after it was last set. Setting key with any other
+// setter makes it non-transient.
+func SetTransient(key string, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	setAttrsLocked(key, err, SeverityWarning, "", true)
+	checkLoopOnce.Do(func() { go checkLoop() })
+}
+
+// IsTransient reports whether key's current error was set by
+// SetTransient.
+func IsTransient(key string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	e, ok := m[key]
+	return ok && e.transient
+}
+
+// expireTransientLocked clears the transient errors that haven't been
+// set again for transientTTL.
+//
+// mu must be held.
+func expireTransientLocked(now time.Time) {
+	wasHealthy := overallHealthyLocked()
+	for key, e := range m {
+		if e.transient && now.Sub(e.lastSet) >= transientTTL {
+			updateLocked(key, nil, e.sev, now)
+		}
+	}
+	notifyOverallLocked(wasHealthy)
+}
+
+// SeverityOf returns the severity of the error key, or zero if it's
+// healthy or unknown.
+func SeverityOf(key string) Severity {
+	mu.Lock()
+	defer mu.Unlock()
+	if e, ok := m[key]; ok && e.err != nil {
+		return e.sev
+	}
+	return 0
+}
+
+// BySeverity returns the currently unhealthy error keys grouped by
+// their severity, each group sorted. Healthy keys are left out, as
+// are severities with no keys. It's consistent with a single point in
+// time, unlike a series of SeverityOf calls.
+func BySeverity() map[Severity][]string {
+	mu.Lock()
+	defer mu.Unlock()
+	ret := map[Severity][]string{}
+	for key, e := range m {
+		if e.err != nil {
+			ret[e.sev] = append(ret[e.sev], key)
+		}
+	}
+	for _, keys := range ret {
+		sort.Strings(keys)
+	}
+	return ret
+}
+
+// SetFirewallProcessRuleWarning sets or clears the warning that the
+// firewall rule allowing tailscaled's inbound UDP couldn't be added,
+// which may prevent direct connections.
+func SetFirewallProcessRuleWarning(err error) {
+	setSeverity("firewall-process-rule", err, SeverityWarning)
+}
+
+// keyExpiryWarning is how long before the node key expires that
+// SetKeyExpiry starts warning about it.
+const keyExpiryWarning = 24 * time.Hour
+
+// SetKeyExpiry sets when the node key expires, or the zero time if it
+// doesn't. Within keyExpiryWarning of then, a key-expiry warning is
+// set; once it has passed, it becomes an error.
+func SetKeyExpiry(t time.Time) {
+	mu.Lock()
+	keyExpiry = t
+	updateKeyExpiryLocked()
+	mu.Unlock()
+	// The state changes as time passes, so make sure something
+	// re-evaluates it.
+	checkLoopOnce.Do(func() { go checkLoop() })
+}
+
+// updateKeyExpiryLocked sets the key-expiry state as of now.
+//
+// mu must be held.
+func updateKeyExpiryLocked() {
+	const key = "key-expiry"
+	if keyExpiry.IsZero() {
+		if _, ok := m[key]; ok {
+			setLocked(key, nil, SeverityWarning)
 		}
 		return
 	}
-	m[key] = err
-	for _, cb := range watchers {
-		go cb(key, err)
+	left := keyExpiry.Sub(timeNow())
+	switch {
+	case left <= 0:
+		setLocked(key, fmt.Errorf("node key expired at %v; log in again to reconnect", keyExpiry.Format(time.RFC3339)), SeverityError)
+	case left < keyExpiryWarning:
+		setLocked(key, fmt.Errorf("node key expires in %v", left.Round(time.Minute)), SeverityWarning)
+	default:
+		setLocked(key, nil, SeverityWarning)
+	}
+}
+
+// SetNodeExpired sets whether control reports the node as expired,
+// which stops all connectivity until it's re-authenticated. Unlike
+// the "key-expiry" state, which follows the expiry time the netmap
+// gave, this is control's verdict, so it's the "node-expired" error,
+// with a hint of how to re-authenticate.
+func SetNodeExpired(expired bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	const key = "node-expired"
+	if !expired {
+		if e, ok := m[key]; ok && e.err != nil {
+			setLocked(key, nil, SeverityError)
+		}
+		return
+	}
+	setAttrsLocked(key, errors.New("this device's login has expired, so it can't connect to the tailnet"), SeverityError,
+		`re-authenticate by running "tailscale up" or logging in again from the Tailscale menu`, false)
+}
+
+// SetFirewallRuleLeakWarning sets or clears the warning that more
+// firewall rules are installed than the router intends, suggesting
+// they're being leaked.
+func SetFirewallRuleLeakWarning(err error) {
+	setSeverity("firewall-rule-leak", err, SeverityWarning)
+}
+
+// RegisterFirewallRuleLeakCheck registers check to be polled for
+// whether firewall rules are being leaked, as with RegisterCheck. Its
+// errors are warnings.
+func RegisterFirewallRuleLeakCheck(check func() error) (unregister func()) {
+	return registerCheck("firewall-rule-leak", check, SeverityWarning)
+}
+
+// SetFirewallProfileMismatchWarning sets or clears the warning that
+// the router's firewall rules aren't effective in the firewall profile
+// of the Tailscale adapter's network.
+func SetFirewallProfileMismatchWarning(err error) {
+	setSeverity("firewall-profile-mismatch", err, SeverityWarning)
+}
+
+// RegisterFirewallProfileMismatchCheck registers check to be polled
+// for whether the router's firewall rules apply to the Tailscale
+// adapter's firewall profile, as with RegisterCheck. Its errors are
+// warnings.
+func RegisterFirewallProfileMismatchCheck(check func() error) (unregister func()) {
+	return registerCheck("firewall-profile-mismatch", check, SeverityWarning)
+}
+
+// SetRouteApproval notes the subnet and exit node routes this node
+// advertises and which of them control has approved. It sets a
+// warning listing any advertised routes that aren't approved yet and
+// clears it once they all are.
+func SetRouteApproval(advertised, approved []netaddr.IPPrefix) {
+	ok := make(map[netaddr.IPPrefix]bool, len(approved))
+	for _, p := range approved {
+		ok[p] = true
+	}
+	var pending []string
+	for _, p := range advertised {
+		if !ok[p] {
+			pending = append(pending, p.String())
+		}
+	}
+	var err error
+	if len(pending) > 0 {
+		err = fmt.Errorf("advertised routes awaiting approval in the admin panel: %s", strings.Join(pending, ", "))
+	}
+	setSeverity("routes-pending-approval", err, SeverityWarning)
+}
+
+// GotStreamedMapResponse notes that we got a tailcfg.MapResponse
+// message in streaming mode, even if it's just a keep-alive message.
+func GotStreamedMapResponse() {
+	mu.Lock()
+	defer mu.Unlock()
+	lastStreamedMapResponse = timeNow()
+	updateMapResponseLocked()
+
+	// Hearing from control means we're not stuck behind a captive portal.
+	if e, ok := m["captive-portal"]; ok && e.err != nil {
+		setLocked("captive-portal", nil, SeverityWarning)
+	}
+}
+
+// SetInPollNetMap records whether the client has an open
+// HTTP long poll open to the control plane. A true v, meaning a poll
+// delivered a netmap, clears the "map-poll" error from
+// SetInPollNetMapReason; a false one leaves it alone, so that the
+// error stays set while the client backs off before polling again.
+func SetInPollNetMap(v bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if v {
+		clearMapPollLocked()
+	}
+	setInMapPollLocked(v)
+}
+
+// SetInPollNetMapReason is like SetInPollNetMap, but when v is false,
+// reason says why the poll ended: nil if it ended normally, or the
+// error that killed it. An error is reported as the "map-poll" error
+// right away, rather than waiting for the poll to be missed. It's
+// cleared when a poll ends normally or delivers a netmap.
+func SetInPollNetMapReason(v bool, reason error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !v && reason != nil {
+		setLocked("map-poll", fmt.Errorf("map poll ended: %v", reason), SeverityError)
+	} else {
+		clearMapPollLocked()
+	}
+	setInMapPollLocked(v)
+}
+
+// clearMapPollLocked clears the "map-poll" error, if it's set.
+//
+// mu must be held.
+func clearMapPollLocked() {
+	if e, ok := m["map-poll"]; ok && e.err != nil {
+		setLocked("map-poll", nil, SeverityError)
+	}
+}
+
+// setInMapPollLocked records whether a map poll is open.
+//
+// mu must be held.
+func setInMapPollLocked(v bool) {
+	if v == inMapPoll {
+		return
+	}
+	inMapPoll = v
+	if v {
+		inMapPollSince = timeNow()
+		// The poll goes stale as time passes, so make sure
+		// something re-evaluates it.
+		checkLoopOnce.Do(func() { go checkLoop() })
+	}
+	updateMapResponseLocked()
+}
+
+// NoteMapRequestHeard notes whenever we successfully sent a map request
+// to control for which we received a 200 response.
+//
+// If mr carries NetInfo, the "nat-type" and "derp-home" warnings are
+// updated from it.
+func NoteMapRequestHeard(mr *tailcfg.MapRequest) {
+	mu.Lock()
+	defer mu.Unlock()
+	lastMapRequestHeard = timeNow()
+	if mr != nil && mr.Hostinfo != nil && mr.Hostinfo.NetInfo != nil {
+		ni := mr.Hostinfo.NetInfo
+		updateNATTypeLocked(ni)
+		advertisedDERPHome = ni.PreferredDERP
+		updateDERPHomeLocked()
+	}
+}
+
+// updateNATTypeLocked sets the "nat-type" warning if ni reports a hard
+// NAT, one whose mappings vary by destination, which forces peers to
+// use DERP. It's left alone if ni doesn't know yet.
+//
+// mu must be held.
+func updateNATTypeLocked(ni *tailcfg.NetInfo) {
+	hard, ok := ni.MappingVariesByDestIP.Get()
+	if !ok {
+		return
+	}
+	if hard {
+		setLocked("nat-type", errors.New("behind a hard NAT; direct connections are unlikely and traffic may be relayed through DERP"), SeverityWarning)
+	} else if e, ok := m["nat-type"]; ok && e.err != nil {
+		setLocked("nat-type", nil, SeverityWarning)
+	}
+}
+
+// SetPeerCount records how many peers are in the latest netmap. A drop
+// to zero after there have been peers sets the "no-peers" warning, as
+// it usually means an ACL or tagging change cut the node off; a node
+// that never had peers isn't warned about. It's cleared when peers
+// return.
+func SetPeerCount(n int) {
+	mu.Lock()
+	defer mu.Unlock()
+	if n > 0 {
+		hadPeers = true
+		if e, ok := m["no-peers"]; ok && e.err != nil {
+			setLocked("no-peers", nil, SeverityWarning)
+		}
+		return
+	}
+	if hadPeers {
+		setLocked("no-peers", errors.New("netmap has no peers; check ACLs and tags in the admin panel"), SeverityWarning)
+	}
+}
+
+// DiagInfo reports how long ago various health-related events
+// happened, for bug reports. A zero duration means the event hasn't
+// happened (or, for InMapPoll, that no long poll is open).
+type DiagInfo struct {
+	// SinceStreamedMapResponse is the time since the last map
+	// response, including keep-alives, was received from control.
+	SinceStreamedMapResponse time.Duration
+	// SinceMapRequestHeard is the time since control last
+	// accepted a map request.
+	SinceMapRequestHeard time.Duration
+	// InMapPoll is how long the current map long poll has been open.
+	InMapPoll time.Duration
+	// SinceRouterChange is the time since the router last became
+	// healthy or unhealthy.
+	SinceRouterChange time.Duration
+}
+
+// Diagnostics returns how long before now the events in DiagInfo
+// happened.
+func Diagnostics(now time.Time) DiagInfo {
+	mu.Lock()
+	defer mu.Unlock()
+	since := func(t time.Time) time.Duration {
+		if t.IsZero() {
+			return 0
+		}
+		return now.Sub(t)
+	}
+	di := DiagInfo{
+		SinceStreamedMapResponse: since(lastStreamedMapResponse),
+		SinceMapRequestHeard:     since(lastMapRequestHeard),
+	}
+	if inMapPoll {
+		di.InMapPoll = since(inMapPollSince)
+	}
+	if e, ok := m["router"]; ok {
+		di.SinceRouterChange = since(e.changed)
+	}
+	return di
+}
+
+// Weights of the inputs to Score. They sum to 100.
+const (
+	scoreRouter   = 30 // router has no error
+	scoreDNS      = 20 // MagicDNS, if configured, is answering
+	scoreMapPoll  = 30 // in a map poll that's heard from control recently
+	scoreDERPHome = 20 // magicsock has a home DERP region and is connected to it
+)
+
+// defaultMapPollStaleAfter is the default for
+// SetMapResponseStaleThreshold.
+const defaultMapPollStaleAfter = 2 * time.Minute
+
+// SetMapResponseStaleThreshold sets how long an open map poll can go
+// without a response from control, including keep-alives, before it's
+// reported as the "map-response" error and no longer counts toward
+// Score. Control servers that send keep-alives less often than the
+// default of two minutes need a longer one. A d of zero or less
+// restores the default.
+func SetMapResponseStaleThreshold(d time.Duration) {
+	if d <= 0 {
+		d = defaultMapPollStaleAfter
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	mapPollStaleAfter = d
+	updateMapResponseLocked()
+}
+
+// mapPollStaleLocked reports whether an open map poll hasn't heard
+// from control, or opened, within mapPollStaleAfter. It's false if
+// there's no map poll.
+//
+// mu must be held.
+func mapPollStaleLocked() bool {
+	if !inMapPoll {
+		return false
+	}
+	last := lastStreamedMapResponse
+	if inMapPollSince.After(last) {
+		last = inMapPollSince
+	}
+	return timeNow().Sub(last) >= mapPollStaleAfter
+}
+
+// updateMapResponseLocked sets the "map-response" error if
+// mapPollStaleLocked.
+//
+// mu must be held.
+func updateMapResponseLocked() {
+	const key = "map-response"
+	var err error
+	if mapPollStaleLocked() {
+		err = fmt.Errorf("no map response from control in over %v", mapPollStaleAfter)
+	}
+	if e, ok := m[key]; err != nil || (ok && e.err != nil) {
+		setLocked(key, err, SeverityError)
+	}
+}
+
+// Score returns a rough 0-100 measure of the node's connectivity, for
+// UIs that want a single gauge. It's the sum of the weights of the
+// inputs that are healthy: the router (30), MagicDNS (20), a fresh
+// map poll (30) and a home DERP region that magicsock is connected to
+// (20). Whether peers are reached directly or through DERP isn't part
+// of it, as the health package doesn't track that.
+func Score() int {
+	mu.Lock()
+	defer mu.Unlock()
+	healthy := func(key string) bool {
+		e, ok := m[key]
+		return !ok || e.err == nil
+	}
+	score := 0
+	if healthy("router") {
+		score += scoreRouter
+	}
+	if healthy("magicdns") {
+		score += scoreDNS
+	}
+	if inMapPoll && !mapPollStaleLocked() {
+		score += scoreMapPoll
+	}
+	if _, ok := derpRegionConnected[derpHomeRegion]; derpHomeRegion != 0 && ok {
+		score += scoreDERPHome
+	}
+	return score
+}
+
+// SetMagicSockDERPHome notes what magicsock's view of its home DERP
+// region is, or 0 if it has none. See updateDERPHomeLocked for how it's
+// compared with what control was told.
+func SetMagicSockDERPHome(region int) {
+	mu.Lock()
+	defer mu.Unlock()
+	derpHomeRegion = region
+	updateDERPHomeLocked()
+}
+
+// updateDERPHomeLocked sets the "derp-home" warning if magicsock's
+// home DERP region differs from the one last advertised to control,
+// in which case peers look for the node on the wrong region. Either
+// side catching up to the other clears it right away. It's left
+// alone while either one is unknown.
+//
+// mu must be held.
+func updateDERPHomeLocked() {
+	const key = "derp-home"
+	var err error
+	if derpHomeRegion != 0 && advertisedDERPHome != 0 && derpHomeRegion != advertisedDERPHome {
+		err = fmt.Errorf("home DERP region is %d, but control was told %d", derpHomeRegion, advertisedDERPHome)
+	}
+	if e, ok := m[key]; err != nil || (ok && e.err != nil) {
+		setLocked(key, err, SeverityWarning)
+	}
+}
+
+const (
+	// derpLatencyRegressionFactor is how many times slower than
+	// its recent average the home DERP region's latency must get
+	// for us to warn about it.
+	derpLatencyRegressionFactor = 3
+	// derpLatencyRegressionMin is the latency below which we don't
+	// warn, no matter how much worse than average it is.
+	derpLatencyRegressionMin = 100 * time.Millisecond
+)
+
+// NoteDERPRegionLatency notes a measured round-trip latency to a DERP
+// region. If the home region's latency is suddenly much worse than
+// its recent average, a derp-latency warning is set until it
+// improves.
+func NoteDERPRegionLatency(region int, d time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	avg, ok := derpLatency[region]
+	if !ok {
+		derpLatency[region] = d
+	} else {
+		derpLatency[region] = (avg*7 + d) / 8
+	}
+	if region != derpHomeRegion || !ok {
+		return
+	}
+	var err error
+	if d >= derpLatencyRegressionMin && d > avg*derpLatencyRegressionFactor {
+		err = fmt.Errorf("latency to home DERP region %d is %v, up from an average of %v",
+			region, d.Round(time.Millisecond), avg.Round(time.Millisecond))
+	}
+	setLocked("derp-latency", err, SeverityWarning)
+}
+
+// DERPRegionLatencies returns the moving average of measured latency
+// to each DERP region.
+func DERPRegionLatencies() map[int]time.Duration {
+	mu.Lock()
+	defer mu.Unlock()
+	ret := make(map[int]time.Duration, len(derpLatency))
+	for k, v := range derpLatency {
+		ret[k] = v
+	}
+	return ret
+}
+
+// SetDERPRegionConnectedState notes whether magicsock has a working
+// connection to the given DERP region.
+func SetDERPRegionConnectedState(region int, connected bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if !connected {
+		delete(derpRegionConnected, region)
+	} else if _, ok := derpRegionConnected[region]; !ok {
+		derpRegionConnected[region] = timeNow()
+	}
+}
+
+// DERPRegionConnectedSince returns, for each DERP region magicsock is
+// connected to, when its current connection started. A region whose
+// time keeps moving forward is flapping.
+func DERPRegionConnectedSince() map[int]time.Time {
+	mu.Lock()
+	defer mu.Unlock()
+	ret := make(map[int]time.Time, len(derpRegionConnected))
+	for region, t := range derpRegionConnected {
+		ret[region] = t
+	}
+	return ret
+}
+
+// ConnectedDERPRegions returns the sorted IDs of the DERP regions
+// magicsock is currently connected to.
+func ConnectedDERPRegions() []int {
+	mu.Lock()
+	defer mu.Unlock()
+	ret := make([]int, 0, len(derpRegionConnected))
+	for region := range derpRegionConnected {
+		ret = append(ret, region)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+// SetHealthyTTL sets how long a healthy key may go without being set
+// before it's forgotten, as if it had never been reported. Unhealthy
+// keys are never forgotten. Zero, the default, disables eviction.
+//
+// Eviction happens in RunChecks and Snapshot, not on every set, so a
+// key can outlive the TTL by up to the periodic check interval.
+func SetHealthyTTL(d time.Duration) {
+	mu.Lock()
+	healthyTTL = d
+	mu.Unlock()
+	if d > 0 {
+		checkLoopOnce.Do(func() { go checkLoop() })
+	}
+}
+
+// LastChange returns when key last became healthy or unhealthy, or the
+// zero time if its state is unknown.
+func LastChange(key string) time.Time {
+	mu.Lock()
+	defer mu.Unlock()
+	if e, ok := m[key]; ok {
+		return e.changed
+	}
+	return time.Time{}
+}
+
+// FirstHealthy returns when key was first reported healthy in this
+// process, or the zero time if it never has been. Unlike LastChange,
+// it isn't updated when the key later flaps.
+func FirstHealthy(key string) time.Time {
+	mu.Lock()
+	defer mu.Unlock()
+	if e, ok := m[key]; ok {
+		return e.firstHealthy
+	}
+	return time.Time{}
+}
+
+// OverallError returns a summary of all error-severity health
+// problems, or nil if there are none. Warnings don't affect it.
+// Permanent errors are marked as requiring action.
+func OverallError() error {
+	mu.Lock()
+	defer mu.Unlock()
+	return overallErrorLocked()
+}
+
+// ReadyStatus returns an HTTP status code summarizing health, for
+// load balancers and readiness probes:
+//
+//   - 503 (Service Unavailable) if OverallError is non-nil;
+//   - 200 (OK) otherwise, even with warnings.
+//
+// Warnings don't fail the probe, as Kubernetes fails one on any code
+// of 400 or more.
+func ReadyStatus() int {
+	mu.Lock()
+	defer mu.Unlock()
+	code, _ := readyLocked()
+	return code
+}
+
+// readyLocked returns ReadyStatus along with a one-line detail for a
+// response body: OverallError's text with a 503, and otherwise any
+// warnings, or "ok" if there are none.
+//
+// mu must be held.
+func readyLocked() (code int, detail string) {
+	if err := overallErrorLocked(); err != nil {
+		return http.StatusServiceUnavailable, err.Error()
+	}
+	var warns []string
+	for key, e := range m {
+		if e.err != nil {
+			warns = append(warns, fmt.Sprintf("%s: %v", key, e.err))
+		}
+	}
+	if len(warns) == 0 {
+		return http.StatusOK, "ok"
+	}
+	sort.Strings(warns)
+	return http.StatusOK, "warnings: " + strings.Join(warns, "; ")
+}
+
+// ServeReady is an HTTP handler for readiness probes, replying with
+// ReadyStatus and, in the body, the errors or warnings behind it.
+func ServeReady(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	code, detail := readyLocked()
+	mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintln(w, detail)
+}
+
+// offlineReasons are the likely root causes of the node being offline
+// that OfflineReason looks for, most fundamental first: for instance,
+// with no internet access, control being unreachable follows, so it's
+// not worth mentioning.
+var offlineReasons = []struct {
+	failing func() bool // called with mu held
+	reason  string
+}{
+	{errorSet("state-store"), "Tailscale can't read or write its saved state"},
+	{errorSet("no-default-route"), "this device isn't connected to the internet"},
+	{isSet("captive-portal", SeverityWarning), "the network requires signing in through a browser first"},
+	{errorSet("tun-missing"), "the Tailscale network adapter is missing"},
+	{errorSet("tun-down"), "the Tailscale network adapter is down"},
+	{errorSet("router"), "the Tailscale network adapter couldn't be configured"},
+	{errorSet("key-expiry"), "this device's key has expired; log in again"},
+	{errorSet("node-expired"), "this device's login has expired; log in again"},
+	{errorSet("map-poll"), "Tailscale can't reach its coordination server"},
+	{errorSet("map-response"), "the coordination server has stopped responding"},
+	{noDERPLocked, "Tailscale can't reach any of its relay (DERP) servers"},
+	{errorSet("dns-timeout"), "the system DNS settings couldn't be updated"},
+	{errorSet("magicdns"), "Tailscale's DNS resolver isn't answering"},
+}
+
+// isSet returns an offlineReasons func for whether key has an error
+// of at least severity min.
+func isSet(key string, min Severity) func() bool {
+	return func() bool {
+		e, ok := m[key]
+		return ok && e.err != nil && e.sev >= min
+	}
+}
+
+func errorSet(key string) func() bool { return isSet(key, SeverityError) }
+
+// noDERPLocked reports whether magicsock has picked a home DERP region
+// but isn't connected to any region.
+//
+// mu must be held.
+func noDERPLocked() bool {
+	return derpHomeRegion != 0 && len(derpRegionConnected) == 0
+}
+
+// OfflineReason returns the most likely root cause of the node not
+// working, in plain language for a "diagnose" button. It picks the
+// most fundamental of the problems it knows about, in order: saved
+// state, the internet connection, captive portals, the Tailscale
+// adapter, the node key, control, DERP and finally DNS. Any other
+// error is described by its key and error. It returns ok=false if
+// there are no errors.
+func OfflineReason() (reason string, ok bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	return offlineReasonLocked()
+}
+
+// offlineReasonLocked is OfflineReason with mu held.
+func offlineReasonLocked() (reason string, ok bool) {
+	for _, r := range offlineReasons {
+		if r.failing() {
+			return r.reason, true
+		}
+	}
+	var keys []string
+	for key, e := range m {
+		if e.err != nil && e.sev >= SeverityError {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return "", false
+	}
+	sort.Strings(keys)
+	return fmt.Sprintf("%s: %v", keys[0], m[keys[0]].err), true
+}
+
+// TooltipText returns a short summary of the node's health for a
+// system tray tooltip, so every frontend shows the same text. The
+// first line is "Connected", with the exit node if there is one, or
+// "Offline: " and the OfflineReason. It's followed by the tailnet, if
+// known, and, when connected, by any warnings. For example:
+//
+//	Connected · Exit node: home-pi
+//	Tailnet: example.com
+//	Warning: advertised routes awaiting approval
+func TooltipText() string {
+	mu.Lock()
+	defer mu.Unlock()
+	reason, offline := offlineReasonLocked()
+	var lines []string
+	if offline {
+		lines = append(lines, "Offline: "+reason)
+	} else if exit := info["exit-node"]; exit != "" {
+		lines = append(lines, "Connected · Exit node: "+exit)
+	} else {
+		lines = append(lines, "Connected")
+	}
+	if tailnet := info["tailnet"]; tailnet != "" {
+		lines = append(lines, "Tailnet: "+tailnet)
+	}
+	if offline {
+		return strings.Join(lines, "\n")
+	}
+	var warnings []string
+	for key, e := range m {
+		if e.err != nil && e.sev == SeverityWarning {
+			warnings = append(warnings, key)
+		}
+	}
+	switch len(warnings) {
+	case 0:
+	case 1:
+		lines = append(lines, fmt.Sprintf("Warning: %v", m[warnings[0]].err))
+	default:
+		lines = append(lines, fmt.Sprintf("%d warnings", len(warnings)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func overallErrorLocked() error {
+	var errs []string
+	for key, e := range m {
+		if e.err == nil || e.sev < SeverityError {
+			continue
+		}
+		if e.sev == SeverityPermanent {
+			errs = append(errs, fmt.Sprintf("%s: %v (requires action)", key, e.err))
+		} else {
+			errs = append(errs, fmt.Sprintf("%s: %v", key, e.err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Strings(errs)
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// overallHealthyLocked reports whether overallErrorLocked would
+// return nil, without constructing the error.
+func overallHealthyLocked() bool {
+	for _, e := range m {
+		if e.err != nil && e.sev >= SeverityError {
+			return false
+		}
+	}
+	return true
+}
+
+func get(key string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if e, ok := m[key]; ok {
+		return e.err
+	}
+	return nil
+}
+
+func set(key string, err error) { setSeverity(key, err, SeverityError) }
+
+// SetWithHint is like set, but attaches hint to err: a short
+// suggestion of how to fix it, such as "run tailscale up", for UIs to
+// show as a "how to fix" line. Each set of key replaces the hint, so
+// one made without a hint clears it, as does the key becoming healthy.
+func SetWithHint(key string, err error, hint string) {
+	mu.Lock()
+	defer mu.Unlock()
+	setAttrsLocked(key, err, SeverityError, hint, false)
+}
+
+// setAttrsLocked is setLocked for setters that attach a hint or the
+// transient flag to err. If key's error is being held back (see
+// NoteSleep), they're kept with it and applied when it's released.
+//
+// mu must be held.
+func setAttrsLocked(key string, err error, sev Severity, hint string, transient bool) {
+	setLocked(key, err, sev)
+	if err == nil {
+		return
+	}
+	if h, ok := held[key]; ok {
+		h.hint, h.transient = hint, transient
+		held[key] = h
+		return
+	}
+	applyAttrsLocked(key, hint, transient)
+}
+
+// applyAttrsLocked attaches hint and the transient flag to key's
+// current error, if it has one.
+//
+// mu must be held.
+func applyAttrsLocked(key, hint string, transient bool) {
+	if e, ok := m[key]; ok && e.err != nil {
+		e.hint, e.transient = hint, transient
+	}
+}
+
+// Hint returns the hint attached to key's current error by
+// SetWithHint, or the empty string if there's none.
+func Hint(key string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	if e, ok := m[key]; ok {
+		return e.hint
+	}
+	return ""
+}
+
+// HealthDetail is everything known about one error key, as returned
+// by Detail and Snapshot.
+type HealthDetail struct {
+	Key      string
+	Err      error    // or nil if the key is healthy
+	Severity Severity // of Err, or of the last error if healthy
+	Hint     string   // how to fix Err, if known; see SetWithHint
+
+	LastSet      time.Time // last time the key was set
+	Changed      time.Time // last time it went between healthy and unhealthy
+	FirstHealthy time.Time // first time it was healthy, or zero if never
+	Escalated    bool      // Err was promoted from a warning; see SetEscalation
+	Transient    bool      // Err was set by SetTransient
+}
+
+// Detail returns all of key's state in one read, so it's consistent,
+// unlike separate calls to get, SeverityOf, Hint and LastChange. It
+// returns false if key has never been set.
+func Detail(key string) (HealthDetail, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	e, ok := m[key]
+	if !ok {
+		return HealthDetail{}, false
+	}
+	return e.detail(key), true
+}
+
+// Snapshot returns the Detail of every known error key, sorted by
+// key. It first evicts the healthy keys that outlived the healthy
+// TTL, if one is set.
+func Snapshot() []HealthDetail {
+	mu.Lock()
+	defer mu.Unlock()
+	evictHealthyLocked(timeNow())
+	ret := make([]HealthDetail, 0, len(m))
+	for key, e := range m {
+		ret = append(ret, e.detail(key))
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret
+}
+
+// detail returns e, the state of key, as a HealthDetail.
+func (e *entry) detail(key string) HealthDetail {
+	return HealthDetail{
+		Key:          key,
+		Err:          e.err,
+		Severity:     e.sev,
+		Hint:         e.hint,
+		LastSet:      e.lastSet,
+		Changed:      e.changed,
+		FirstHealthy: e.firstHealthy,
+		Escalated:    e.escalated,
+		Transient:    e.transient,
+	}
+}
+
+// setSeverity is like set but records err with severity sev.
+func setSeverity(key string, err error, sev Severity) {
+	mu.Lock()
+	defer mu.Unlock()
+	setLocked(key, err, sev)
+}
+
+// Reset clears all health state back to how it is at startup: every
+// error key, Info, and the map poll, key expiry, sleep and DERP state. Watchers
+// are notified that any unhealthy keys are now healthy.
+//
+// Registered watchers and checks are kept, as is the healthy TTL; use
+// their unregister funcs to remove them.
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	now := timeNow()
+	wasHealthy := overallHealthyLocked()
+	var unhealthy []string
+	for key, e := range m {
+		if e.err != nil {
+			unhealthy = append(unhealthy, key)
+		}
+	}
+	sort.Strings(unhealthy)
+	for _, key := range unhealthy {
+		updateLocked(key, nil, m[key].sev, now)
+	}
+
+	m = map[string]*entry{}
+	info = map[string]string{}
+	inMapPoll = false
+	inMapPollSince = time.Time{}
+	lastStreamedMapResponse = time.Time{}
+	lastMapRequestHeard = time.Time{}
+	keyExpiry = time.Time{}
+	hadPeers = false
+	sleeping, resumedAt, held = false, time.Time{}, nil
+	derpHomeRegion = 0
+	advertisedDERPHome = 0
+	derpLatency = map[int]time.Duration{}
+	derpRegionConnected = map[int]time.Time{}
+	notifyOverallLocked(wasHealthy)
+}
+
+// SetMany sets the state of several error keys at once, as if by set,
+// with the error severity. All updates are applied under a single
+// lock hold, so an overall watcher fires at most once for the batch
+// and observers never see it half applied. Watchers are still called
+// once for each key whose state changed.
+func SetMany(updates map[string]error) {
+	keys := make([]string, 0, len(updates))
+	for k := range updates {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	mu.Lock()
+	defer mu.Unlock()
+	now := timeNow()
+	wasHealthy := overallHealthyLocked()
+	for _, k := range keys {
+		updateLocked(k, updates[k], SeverityError, now)
+	}
+	notifyOverallLocked(wasHealthy)
+}
+
+// setLocked is the implementation of setSeverity.
+//
+// mu must be held.
+func setLocked(key string, err error, sev Severity) {
+	now := timeNow()
+	wasHealthy := overallHealthyLocked()
+	defer notifyOverallLocked(wasHealthy)
+	updateLocked(key, err, sev, now)
+}
+
+// updateLocked records err for key at time now and queues transitions
+// to the key watchers, but doesn't notify overall watchers or evict
+// stale keys.
+//
+// mu must be held.
+func updateLocked(key string, err error, sev Severity, now time.Time) {
+	e, ok := m[key]
+	if connectivityKeys[key] && (sleeping || !resumedAt.IsZero()) {
+		if err != nil && (!ok || e.err == nil) {
+			if held == nil {
+				held = map[string]pausedKey{}
+			}
+			held[key] = pausedKey{err: err, sev: sev}
+			return
+		}
+		delete(held, key)
+	}
+	if !ok && err == nil {
+		// Initial happy path.
+		m[key] = &entry{lastSet: now, changed: now, firstHealthy: now}
+		return
+	}
+	if !ok {
+		e = new(entry)
+		m[key] = e
+	}
+	e.lastSet = now
+	e.hint = ""
+	e.transient = false
+	oldErr, oldSev := e.err, e.sev
+	if err != nil {
+		e.sev = sev
+		if e.escalated && sev < SeverityError {
+			e.sev = SeverityError
+		}
+	}
+	if ok && (e.err == nil) == (err == nil) {
+		// No change in overall error status (nil-vs-not), so
+		// don't run callbacks, but exact error might've
+		// changed, so note it. Subsystems often report the
+		// same error every poll; keep the old value if it
+		// reads the same or has the same cause.
+		if err != nil && !sameErrorLocked(err, e.err) {
+			e.err = err
+		}
+		if err == nil || e.sev == oldSev {
+			return
+		}
+		// Still unhealthy, but severity watchers may see it cross
+		// their minimum.
+		if pauses > 0 {
+			if _, ok := pausedFrom[key]; !ok {
+				pausedFrom[key] = pausedKey{err: oldErr, sev: oldSev}
+			}
+			return
+		}
+		queueTransitionLocked(key, e.sev, oldErr, e.err)
+		return
+	}
+	e.err = err
+	e.changed = now
+	e.escalated = false
+	if err == nil && e.firstHealthy.IsZero() {
+		e.firstHealthy = now
+	}
+	recordTransitionLocked(HealthEvent{When: now, Key: key, Severity: e.sev, Err: err})
+	if pauses > 0 {
+		if _, ok := pausedFrom[key]; !ok {
+			pausedFrom[key] = pausedKey{err: oldErr, sev: e.sev}
+		}
+		return
+	}
+	queueTransitionLocked(key, e.sev, oldErr, err)
+}
+
+// queueTransitionLocked queues the change of key's error from oldErr
+// to newErr, whose severity is sev, to the key watchers that want it.
+//
+// mu must be held.
+func queueTransitionLocked(key string, sev Severity, oldErr, newErr error) {
+	for w := range watchers {
+		if w.key != "" && w.key != key {
+			continue
+		}
+		t, ok := w.transitionLocked(key, sev, oldErr, newErr)
+		if !ok {
+			continue
+		}
+		w.enqueueLocked(t)
+		if w.once {
+			delete(watchers, w)
+		}
+	}
+}
+
+// transitionLocked returns the transition w is to be told of when
+// key's error changes from oldErr to newErr, whose severity is sev,
+// or false if there's none. Watchers without a minimum severity are
+// told when the key goes between healthy and unhealthy. The others are
+// told when it goes between being unhealthy at least at their
+// minimum and not, judged against what they were last told.
+//
+// mu must be held.
+func (w *watcher) transitionLocked(key string, sev Severity, oldErr, newErr error) (transition, bool) {
+	if w.minSev == 0 {
+		return transition{key, oldErr, newErr}, (oldErr == nil) != (newErr == nil)
+	}
+	unhealthy := newErr != nil && sev >= w.minSev
+	if unhealthy == w.unhealthy[key] {
+		return transition{}, false
+	}
+	if !unhealthy {
+		delete(w.unhealthy, key)
+		return transition{key, oldErr, nil}, true
+	}
+	if w.unhealthy == nil {
+		w.unhealthy = map[string]bool{}
+	}
+	w.unhealthy[key] = true
+	// w wasn't told of any error being set before, whatever oldErr is.
+	return transition{key, nil, newErr}, true
+}
+
+// notifyOverallLocked queues a transition to the overall watchers if
+// the overall health state now differs from wasHealthy.
+//
+// mu must be held.
+func notifyOverallLocked(wasHealthy bool) {
+	if pauses > 0 || len(overallWatchers) == 0 || overallHealthyLocked() == wasHealthy {
+		return
+	}
+	t := transition{newErr: overallErrorLocked()}
+	for w := range overallWatchers {
+		w.enqueueLocked(t)
+	}
+}
+
+// evictHealthyLocked deletes healthy keys that haven't been set
+// within healthyTTL of now.
+//
+// mu must be held.
+func evictHealthyLocked(now time.Time) {
+	if healthyTTL <= 0 {
+		return
+	}
+	for key, e := range m {
+		if e.err == nil && now.Sub(e.lastSet) > healthyTTL {
+			delete(m, key)
+		}
 	}
 }
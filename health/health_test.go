@@ -0,0 +1,1945 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
+)
+
+// resetForTest clears all package state and installs a fake clock,
+// restoring everything when the test ends.
+func resetForTest(t *testing.T) (advance func(time.Duration)) {
+	t.Helper()
+	var (
+		clockMu sync.Mutex
+		now     = time.Unix(1600000000, 0)
+	)
+	resetAll()
+	mu.Lock()
+	timeNow = func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return now
+	}
+	mu.Unlock()
+	t.Cleanup(func() {
+		resetAll()
+		mu.Lock()
+		defer mu.Unlock()
+		timeNow = time.Now
+	})
+	return func(d time.Duration) {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		now = now.Add(d)
+	}
+}
+
+// resetAll is Reset, also clearing what Reset keeps: checks, the
+// healthy TTL, escalations, causes, the map response staleness
+// threshold, recent transitions and pauses.
+func resetAll() {
+	Reset()
+	mu.Lock()
+	defer mu.Unlock()
+	checks = map[string]*check{}
+	healthyTTL = 0
+	escalateAfter = map[string]time.Duration{}
+	causes = nil
+	mapPollStaleAfter = defaultMapPollStaleAfter
+	recentNext, recentLen = 0, 0
+	pauses, pausedFrom, pausedHealthy = 0, nil, false
+}
+
+func TestHealthyTTL(t *testing.T) {
+	advance := resetForTest(t)
+	SetHealthyTTL(time.Minute)
+
+	set("healthy", nil)
+	set("unhealthy", errors.New("boom"))
+	advance(30 * time.Second)
+	set("other", nil)
+	RunChecks()
+	if _, ok := m["healthy"]; !ok {
+		t.Fatal("healthy key evicted before TTL")
+	}
+
+	advance(31 * time.Second)
+	set("other", nil)
+	if _, ok := m["healthy"]; !ok {
+		t.Fatal("healthy key evicted by set; want it left to RunChecks")
+	}
+	RunChecks()
+	if _, ok := m["healthy"]; ok {
+		t.Error("healthy key not evicted after TTL")
+	}
+	if _, ok := m["unhealthy"]; !ok {
+		t.Error("unhealthy key evicted")
+	}
+	if _, ok := m["other"]; !ok {
+		t.Error("recently set key evicted")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	advance := resetForTest(t)
+	SetHealthyTTL(time.Minute)
+
+	set("b", errors.New("b down"))
+	SetWithHint("a", errors.New("a down"), "fix a")
+	set("c", nil)
+	advance(2 * time.Minute)
+
+	var got []string
+	for _, d := range Snapshot() {
+		got = append(got, fmt.Sprintf("%s=%v/%s", d.Key, d.Err, d.Hint))
+	}
+	// c outlived the TTL, so Snapshot evicts it.
+	if want := "a=a down/fix a b=b down/"; strings.Join(got, " ") != want {
+		t.Errorf("Snapshot = %q; want %q", strings.Join(got, " "), want)
+	}
+}
+
+func TestTransitionWatcher(t *testing.T) {
+	resetForTest(t)
+
+	type transition struct{ key, old, new string }
+	errStr := func(err error) string {
+		if err == nil {
+			return ""
+		}
+		return err.Error()
+	}
+	c := make(chan transition, 10)
+	unregister := RegisterTransitionWatcher(func(key string, oldErr, newErr error) {
+		c <- transition{key, errStr(oldErr), errStr(newErr)}
+	})
+	defer unregister()
+
+	set("test", errors.New("down"))
+	if got, want := <-c, (transition{"test", "", "down"}); got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+	set("test", nil)
+	if got, want := <-c, (transition{"test", "down", ""}); got != want {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	advance := resetForTest(t)
+
+	if got := Diagnostics(timeNow()); got != (DiagInfo{}) {
+		t.Errorf("initial Diagnostics = %+v; want zero", got)
+	}
+
+	SetRouterHealth(errors.New("boom"))
+	advance(time.Second)
+	SetInPollNetMap(true)
+	NoteMapRequestHeard(nil)
+	advance(2 * time.Second)
+	GotStreamedMapResponse()
+	advance(3 * time.Second)
+
+	want := DiagInfo{
+		SinceStreamedMapResponse: 3 * time.Second,
+		SinceMapRequestHeard:     5 * time.Second,
+		InMapPoll:                5 * time.Second,
+		SinceRouterChange:        6 * time.Second,
+	}
+	if got := Diagnostics(timeNow()); got != want {
+		t.Errorf("Diagnostics = %+v; want %+v", got, want)
+	}
+
+	SetInPollNetMap(false)
+	if got := Diagnostics(timeNow()).InMapPoll; got != 0 {
+		t.Errorf("InMapPoll after poll ended = %v; want 0", got)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	resetForTest(t)
+
+	SetInfo("router-backend", "netsh")
+	SetInfo("tun-guid", "{guid}")
+	got := Info()
+	if len(got) != 2 || got["router-backend"] != "netsh" || got["tun-guid"] != "{guid}" {
+		t.Errorf("Info = %v", got)
+	}
+	got["router-backend"] = "mutated"
+	if Info()["router-backend"] != "netsh" {
+		t.Error("Info returned an alias of internal state")
+	}
+	SetInfo("router-backend", "")
+	if _, ok := Info()["router-backend"]; ok {
+		t.Error("empty value didn't remove entry")
+	}
+	if RouterHealth() != nil {
+		t.Error("info entry affected error state")
+	}
+}
+
+func TestFirstHealthy(t *testing.T) {
+	advance := resetForTest(t)
+	t0 := timeNow()
+
+	set("test", errors.New("boom"))
+	if got := FirstHealthy("test"); !got.IsZero() {
+		t.Errorf("FirstHealthy while never healthy = %v; want zero", got)
+	}
+	advance(time.Second)
+	set("test", nil)
+	t1 := t0.Add(time.Second)
+	if got := FirstHealthy("test"); !got.Equal(t1) {
+		t.Errorf("FirstHealthy = %v; want %v", got, t1)
+	}
+
+	advance(time.Second)
+	set("test", errors.New("boom"))
+	advance(time.Second)
+	set("test", nil)
+	if got := FirstHealthy("test"); !got.Equal(t1) {
+		t.Errorf("FirstHealthy after flap = %v; want %v", got, t1)
+	}
+	if got, want := LastChange("test"), t0.Add(3*time.Second); !got.Equal(want) {
+		t.Errorf("LastChange = %v; want %v", got, want)
+	}
+}
+
+func TestCaptivePortal(t *testing.T) {
+	resetForTest(t)
+
+	SetCaptivePortal(true)
+	if err := get("captive-portal"); err == nil {
+		t.Fatal("captive portal not reported")
+	}
+	if sev := m["captive-portal"].sev; sev != SeverityWarning {
+		t.Errorf("severity = %v; want %v", sev, SeverityWarning)
+	}
+	GotStreamedMapResponse()
+	if err := get("captive-portal"); err != nil {
+		t.Errorf("captive portal not cleared by map response: %v", err)
+	}
+}
+
+func TestWatcherOrder(t *testing.T) {
+	resetForTest(t)
+
+	const n = 100
+	got := make(chan bool, n)
+	unregister := RegisterTransitionWatcher(func(key string, _, newErr error) {
+		got <- newErr != nil
+	})
+	defer unregister()
+
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			set("test", errors.New("boom"))
+		} else {
+			set("test", nil)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if unhealthy := <-got; unhealthy != (i%2 == 0) {
+			t.Fatalf("transition %d: unhealthy = %v; out of order", i, unhealthy)
+		}
+	}
+}
+
+func TestOverallWatcher(t *testing.T) {
+	resetForTest(t)
+
+	got := make(chan bool, 10)
+	unregister := RegisterOverallWatcher(func(healthy bool) { got <- healthy })
+	defer unregister()
+
+	set("a", nil)
+	set("a", errors.New("a down"))
+	set("b", errors.New("b down"))
+	SetFirewallSlowWarning(errors.New("slow"))
+	set("a", nil)
+	set("b", nil)
+	SetFirewallSlowWarning(nil)
+
+	if err := OverallError(); err != nil {
+		t.Errorf("OverallError = %v; want nil", err)
+	}
+	for i, want := range []bool{false, true} {
+		if healthy := <-got; healthy != want {
+			t.Errorf("event %d: healthy = %v; want %v", i, healthy, want)
+		}
+	}
+	select {
+	case healthy := <-got:
+		t.Errorf("unexpected extra event healthy=%v", healthy)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestOverallError(t *testing.T) {
+	resetForTest(t)
+
+	set("b", errors.New("b down"))
+	set("a", errors.New("a down"))
+	SetFirewallSlowWarning(errors.New("slow"))
+	const want = "a: a down; b: b down"
+	if err := OverallError(); err == nil || err.Error() != want {
+		t.Errorf("OverallError = %v; want %q", err, want)
+	}
+}
+
+func TestReadyStatus(t *testing.T) {
+	resetForTest(t)
+
+	check := func(what string, wantCode int, wantDetail string) {
+		t.Helper()
+		if code := ReadyStatus(); code != wantCode {
+			t.Errorf("%s: ReadyStatus = %d; want %d", what, code, wantCode)
+		}
+		rec := httptest.NewRecorder()
+		ServeReady(rec, httptest.NewRequest("GET", "/ready", nil))
+		if rec.Code != wantCode || rec.Body.String() != wantDetail+"\n" {
+			t.Errorf("%s: ServeReady = %d, %q; want %d, %q", what, rec.Code, rec.Body.String(), wantCode, wantDetail+"\n")
+		}
+	}
+	check("initially", http.StatusOK, "ok")
+
+	SetFirewallSlowWarning(errors.New("slow"))
+	check("with a warning", http.StatusOK, "warnings: firewall-slow: slow")
+
+	set("router", errors.New("router down"))
+	check("with an error and a warning", http.StatusServiceUnavailable, "router: router down")
+
+	SetFirewallSlowWarning(nil)
+	check("with an error", http.StatusServiceUnavailable, "router: router down")
+
+	SetPermanent("firewall", errors.New("access denied"))
+	set("router", nil)
+	check("with a permanent error", http.StatusServiceUnavailable, "firewall: access denied (requires action)")
+
+	SetPermanent("firewall", nil)
+	check("recovered", http.StatusOK, "ok")
+}
+
+func TestOfflineReason(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func()
+		want  string // or empty for healthy
+	}{
+		{
+			name:  "healthy",
+			setup: func() {},
+		},
+		{
+			name:  "warnings only",
+			setup: func() { SetFirewallSlowWarning(errors.New("slow")) },
+		},
+		{
+			name: "no internet hides control",
+			setup: func() {
+				SetDefaultRouteHealth(errors.New("no route"))
+				SetInPollNetMapReason(false, errors.New("dial failed"))
+				set("magicdns", errors.New("timeout"))
+			},
+			want: "this device isn't connected to the internet",
+		},
+		{
+			name: "captive portal",
+			setup: func() {
+				SetCaptivePortal(true)
+				SetInPollNetMapReason(false, errors.New("TLS handshake failed"))
+			},
+			want: "the network requires signing in through a browser first",
+		},
+		{
+			name: "adapter before DNS",
+			setup: func() {
+				set("magicdns", errors.New("timeout"))
+				SetTUNDownHealth(errors.New("down"))
+				SetRouterHealth(errors.New("netsh failed"))
+			},
+			want: "the Tailscale network adapter is down",
+		},
+		{
+			name: "key expiry warning isn't offline",
+			setup: func() {
+				SetKeyExpiry(timeNow().Add(time.Hour))
+				set("magicdns", errors.New("timeout"))
+			},
+			want: "Tailscale's DNS resolver isn't answering",
+		},
+		{
+			name:  "expired key",
+			setup: func() { SetKeyExpiry(timeNow().Add(-time.Hour)) },
+			want:  "this device's key has expired; log in again",
+		},
+		{
+			name: "no DERP",
+			setup: func() {
+				SetMagicSockDERPHome(1)
+				SetDNSTimeoutHealth(errors.New("hung"))
+			},
+			want: "Tailscale can't reach any of its relay (DERP) servers",
+		},
+		{
+			name: "DERP connected",
+			setup: func() {
+				SetMagicSockDERPHome(1)
+				SetDERPRegionConnectedState(1, true)
+				SetDNSTimeoutHealth(errors.New("hung"))
+			},
+			want: "the system DNS settings couldn't be updated",
+		},
+		{
+			name:  "unknown error",
+			setup: func() { set("widget", errors.New("broken")) },
+			want:  "widget: broken",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetForTest(t)
+			tt.setup()
+			got, ok := OfflineReason()
+			if ok != (tt.want != "") || got != tt.want {
+				t.Errorf("OfflineReason = %q, %v; want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	advance := resetForTest(t)
+	SetEscalation("firewall-slow", time.Hour)
+
+	type event struct {
+		oldErr, newErr error
+	}
+	errs := make(chan event, 10)
+	defer RegisterSeverityWatcher(SeverityError, func(_ string, oldErr, newErr error) {
+		errs <- event{oldErr, newErr}
+	})()
+	all := make(chan event, 10)
+	defer RegisterTransitionWatcher(func(_ string, oldErr, newErr error) {
+		all <- event{oldErr, newErr}
+	})()
+	next := func(c <-chan event) event {
+		t.Helper()
+		select {
+		case e := <-c:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for watcher")
+			return event{}
+		}
+	}
+
+	slow := errors.New("slow")
+	SetFirewallSlowWarning(slow)
+	if e := next(all); e.oldErr != nil || e.newErr != slow {
+		t.Errorf("warning set: got %+v", e)
+	}
+	advance(59 * time.Minute)
+	RunChecks()
+	if got := SeverityOf("firewall-slow"); got != SeverityWarning {
+		t.Fatalf("before the hour: severity %v; want warning", got)
+	}
+
+	advance(2 * time.Minute)
+	RunChecks()
+	if got := SeverityOf("firewall-slow"); got != SeverityError {
+		t.Fatalf("after the hour: severity %v; want error", got)
+	}
+	if OverallError() == nil {
+		t.Error("escalated warning doesn't affect OverallError")
+	}
+	if e := next(errs); e.oldErr != nil || e.newErr != slow {
+		t.Errorf("error watcher on escalation: got %+v; want it to become unhealthy", e)
+	}
+	if e := next(all); e.oldErr != slow || e.newErr != slow {
+		t.Errorf("watcher on escalation: got %+v; want unchanged errors", e)
+	}
+
+	// Being set again as a warning doesn't demote it.
+	SetFirewallSlowWarning(slow)
+	if got := SeverityOf("firewall-slow"); got != SeverityError {
+		t.Errorf("set again: severity %v; want error", got)
+	}
+
+	// Once it clears, it starts over as a warning.
+	SetFirewallSlowWarning(nil)
+	if e := next(errs); e.newErr != nil {
+		t.Errorf("error watcher on recovery: got %+v", e)
+	}
+	SetFirewallSlowWarning(slow)
+	if got := SeverityOf("firewall-slow"); got != SeverityWarning {
+		t.Errorf("after recovery: severity %v; want warning", got)
+	}
+}
+
+func TestSleepResume(t *testing.T) {
+	advance := resetForTest(t)
+
+	set("router", errors.New("router down")) // not a connectivity error
+	NoteSleep()
+	if got := Info()["power"]; got != "sleeping" {
+		t.Errorf("power = %q; want sleeping", got)
+	}
+	SetDefaultRouteHealth(errors.New("no route"))
+	NoteResume()
+	if got := Info()["power"]; got != "resuming" {
+		t.Errorf("power = %q; want resuming", got)
+	}
+	SetInPollNetMapReason(false, errors.New("dial failed"))
+	SetDefaultRouteHealth(nil) // recovered within the grace period
+	if err := get("map-poll"); err != nil {
+		t.Errorf("map-poll reported during grace period: %v", err)
+	}
+	if err := get("router"); err == nil {
+		t.Error("non-connectivity error was cleared")
+	}
+
+	advance(resumeGracePeriod / 2)
+	RunChecks()
+	if err := get("map-poll"); err != nil {
+		t.Errorf("map-poll reported during grace period: %v", err)
+	}
+
+	advance(resumeGracePeriod)
+	RunChecks()
+	if err := get("map-poll"); err == nil {
+		t.Error("map-poll still held back after grace period")
+	}
+	if err := DefaultRouteHealth(); err != nil {
+		t.Errorf("recovered error reported after grace period: %v", err)
+	}
+	if got, ok := Info()["power"]; ok {
+		t.Errorf("power = %q after grace period; want unset", got)
+	}
+}
+
+func TestHintWhileSleeping(t *testing.T) {
+	advance := resetForTest(t)
+	NoteSleep()
+	SetWithHint("map-poll", errors.New("dial failed"), "check your network")
+	if err := get("map-poll"); err != nil {
+		t.Errorf("map-poll reported while sleeping: %v", err)
+	}
+	if h := Hint("map-poll"); h != "" {
+		t.Errorf("hint while sleeping = %q; want none", h)
+	}
+
+	NoteResume()
+	advance(resumeGracePeriod)
+	RunChecks()
+	if err := get("map-poll"); err == nil {
+		t.Fatal("map-poll still held back after grace period")
+	}
+	if h := Hint("map-poll"); h != "check your network" {
+		t.Errorf("hint after release = %q; want the held one", h)
+	}
+}
+
+func TestTransient(t *testing.T) {
+	advance := resetForTest(t)
+	blip := errors.New("DERP region 1 unreachable")
+	SetTransient("derp-blip", blip)
+	if !IsTransient("derp-blip") || SeverityOf("derp-blip") != SeverityWarning {
+		t.Fatalf("after SetTransient: transient=%v severity=%v; want true, warning", IsTransient("derp-blip"), SeverityOf("derp-blip"))
+	}
+	if d, _ := Detail("derp-blip"); !d.Transient {
+		t.Error("Detail.Transient = false")
+	}
+
+	// Setting it again refreshes the TTL.
+	advance(transientTTL - time.Second)
+	SetTransient("derp-blip", blip)
+	advance(transientTTL - time.Second)
+	RunChecks()
+	if err := get("derp-blip"); err != blip {
+		t.Fatalf("refreshed transient error = %v; want %v", err, blip)
+	}
+
+	advance(time.Second)
+	RunChecks()
+	if err := get("derp-blip"); err != nil {
+		t.Errorf("transient error after TTL = %v; want cleared", err)
+	}
+	if IsTransient("derp-blip") {
+		t.Error("still transient after clearing")
+	}
+
+	// Another setter makes the key sticky.
+	SetTransient("firewall", blip)
+	SetPermanent("firewall", blip)
+	if IsTransient("firewall") {
+		t.Error("transient after SetPermanent")
+	}
+	advance(2 * transientTTL)
+	RunChecks()
+	if err := get("firewall"); err != blip {
+		t.Errorf("sticky error after TTL = %v; want %v", err, blip)
+	}
+}
+
+func TestTransientWhileSleeping(t *testing.T) {
+	advance := resetForTest(t)
+	set("derp-home", nil) // healthy entry, left alone by the held error
+	NoteSleep()
+	SetTransient("derp-home", errors.New("DERP home unreachable"))
+	if err := get("derp-home"); err != nil {
+		t.Errorf("derp-home reported while sleeping: %v", err)
+	}
+	if IsTransient("derp-home") {
+		t.Error("healthy entry marked transient while its error is held")
+	}
+
+	NoteResume()
+	advance(resumeGracePeriod)
+	RunChecks()
+	if err := get("derp-home"); err == nil {
+		t.Fatal("derp-home still held back after grace period")
+	}
+	if !IsTransient("derp-home") {
+		t.Error("released error isn't transient")
+	}
+	advance(transientTTL)
+	RunChecks()
+	if err := get("derp-home"); err != nil {
+		t.Errorf("released transient error after TTL = %v; want cleared", err)
+	}
+}
+
+func TestDetail(t *testing.T) {
+	advance := resetForTest(t)
+
+	if _, ok := Detail("login"); ok {
+		t.Error("Detail of unset key returned ok")
+	}
+	set("login", nil)
+	healthyAt := timeNow()
+	advance(time.Minute)
+	loggedOut := errors.New("logged out")
+	SetWithHint("login", loggedOut, "run tailscale up")
+	setAt := timeNow()
+
+	got, ok := Detail("login")
+	if !ok {
+		t.Fatal("Detail returned !ok")
+	}
+	want := HealthDetail{
+		Key:          "login",
+		Err:          loggedOut,
+		Severity:     SeverityError,
+		Hint:         "run tailscale up",
+		LastSet:      setAt,
+		Changed:      setAt,
+		FirstHealthy: healthyAt,
+	}
+	if got != want {
+		t.Errorf("Detail = %+v; want %+v", got, want)
+	}
+	if got.Severity != SeverityOf("login") || got.Hint != Hint("login") || !got.Changed.Equal(LastChange("login")) {
+		t.Errorf("Detail %+v disagrees with the single-field accessors", got)
+	}
+}
+
+func TestRegisterCause(t *testing.T) {
+	resetForTest(t)
+	errNoAdapter := errors.New("adapter not found")
+	RegisterCause(errNoAdapter)
+
+	first := fmt.Errorf("configuring interface: %w", errNoAdapter)
+	set("router", first)
+	set("router", fmt.Errorf("retrying after 2s: %w", errNoAdapter))
+	if got := get("router"); got != first {
+		t.Errorf("error with the same cause replaced %q with %q", first, got)
+	}
+
+	other := fmt.Errorf("configuring interface: %w", errors.New("access denied"))
+	set("router", other)
+	if got := get("router"); got != other {
+		t.Errorf("error with a different cause: got %q; want %q", got, other)
+	}
+}
+
+func TestTooltipText(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func()
+		want  string
+	}{
+		{
+			name:  "healthy",
+			setup: func() {},
+			want:  "Connected",
+		},
+		{
+			name: "exit node and tailnet",
+			setup: func() {
+				SetExitNode("home-pi", "nStableID1")
+				SetTailnet("example.com")
+			},
+			want: "Connected · Exit node: home-pi\nTailnet: example.com",
+		},
+		{
+			name: "one warning",
+			setup: func() {
+				SetTailnet("example.com")
+				SetFirewallSlowWarning(errors.New("firewall changes are slow"))
+			},
+			want: "Connected\nTailnet: example.com\nWarning: firewall changes are slow",
+		},
+		{
+			name: "two warnings",
+			setup: func() {
+				SetFirewallSlowWarning(errors.New("slow"))
+				SetRouteConflictWarning(errors.New("overlap"))
+			},
+			want: "Connected\n2 warnings",
+		},
+		{
+			name: "offline",
+			setup: func() {
+				SetExitNode("home-pi", "nStableID1")
+				SetTailnet("example.com")
+				SetFirewallSlowWarning(errors.New("slow"))
+				SetInPollNetMapReason(false, errors.New("dial failed"))
+			},
+			want: "Offline: Tailscale can't reach its coordination server\nTailnet: example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetForTest(t)
+			tt.setup()
+			if got := TooltipText(); got != tt.want {
+				t.Errorf("TooltipText =\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetWithHint(t *testing.T) {
+	resetForTest(t)
+
+	SetWithHint("login", errors.New("logged out"), "run tailscale up")
+	if err := get("login"); err == nil {
+		t.Fatal("no error set")
+	}
+	if got, want := Hint("login"), "run tailscale up"; got != want {
+		t.Errorf("Hint = %q; want %q", got, want)
+	}
+	if got := Hint("other"); got != "" {
+		t.Errorf("Hint of unset key = %q; want empty", got)
+	}
+
+	set("login", errors.New("logged out"))
+	if got := Hint("login"); got != "" {
+		t.Errorf("Hint after set without hint = %q; want empty", got)
+	}
+
+	SetWithHint("login", errors.New("logged out"), "run tailscale up")
+	SetWithHint("login", nil, "ignored")
+	if got := Hint("login"); got != "" {
+		t.Errorf("Hint once healthy = %q; want empty", got)
+	}
+}
+
+func TestRecentTransitions(t *testing.T) {
+	advance := resetForTest(t)
+
+	if got := RecentTransitions(); len(got) != 0 {
+		t.Fatalf("initially = %v; want none", got)
+	}
+
+	t0 := timeNow()
+	set("a", errors.New("a down"))
+	set("a", errors.New("a still down")) // not a transition
+	advance(time.Second)
+	SetFirewallSlowWarning(errors.New("slow"))
+	advance(time.Second)
+	set("a", nil)
+	got := RecentTransitions()
+	want := []struct {
+		key string
+		sev Severity
+		bad bool
+		at  time.Duration
+	}{
+		{"a", SeverityError, true, 0},
+		{"firewall-slow", SeverityWarning, true, time.Second},
+		{"a", SeverityError, false, 2 * time.Second},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d transitions %+v; want %d", len(got), got, len(want))
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Key != w.key || g.Severity != w.sev || (g.Err != nil) != w.bad || !g.When.Equal(t0.Add(w.at)) {
+			t.Errorf("transition %d = %+v; want key %q, severity %v, unhealthy %v, at %v", i, g, w.key, w.sev, w.bad, t0.Add(w.at))
+		}
+	}
+
+	// Past the cap, the oldest are dropped.
+	for i := 0; i < maxRecentTransitions; i++ {
+		set("b", fmt.Errorf("b down %d", i))
+		set("b", nil)
+	}
+	got = RecentTransitions()
+	if len(got) != maxRecentTransitions {
+		t.Fatalf("got %d transitions; want %d", len(got), maxRecentTransitions)
+	}
+	for i, ev := range got {
+		if ev.Key != "b" || (ev.Err == nil) != (i%2 == 1) {
+			t.Fatalf("transition %d = %+v; want b alternating down and up", i, ev)
+		}
+	}
+	if got, want := got[len(got)-2].Err.Error(), fmt.Sprintf("b down %d", maxRecentTransitions-1); got != want {
+		t.Errorf("newest error = %q; want %q", got, want)
+	}
+}
+
+func TestPause(t *testing.T) {
+	resetForTest(t)
+
+	type transition struct{ key, old, new string }
+	errStr := func(err error) string {
+		if err == nil {
+			return ""
+		}
+		return err.Error()
+	}
+	c := make(chan transition, 10)
+	unregister := RegisterTransitionWatcher(func(key string, oldErr, newErr error) {
+		c <- transition{key, errStr(oldErr), errStr(newErr)}
+	})
+	defer unregister()
+	overall := make(chan bool, 10)
+	defer RegisterOverallWatcher(func(healthy bool) { overall <- healthy })()
+
+	set("c", errors.New("c down"))
+	if got, want := <-c, (transition{"c", "", "c down"}); got != want {
+		t.Fatalf("before pause: got %+v; want %+v", got, want)
+	}
+	if healthy := <-overall; healthy {
+		t.Fatal("before pause: overall healthy")
+	}
+
+	resume := Pause()
+	resume2 := Pause()
+	set("a", errors.New("a down"))
+	set("a", nil)
+	set("a", errors.New("a down again"))
+	set("b", errors.New("b down"))
+	set("b", nil)
+	set("c", nil)
+	resume2()
+	resume2()
+	select {
+	case got := <-c:
+		t.Fatalf("delivered while still paused: %+v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := get("a"); err == nil || err.Error() != "a down again" {
+		t.Errorf("state while paused: a = %v; want a down again", err)
+	}
+
+	resume()
+	resume()
+	// Sorted by key; b's round trip isn't reported.
+	for _, want := range []transition{
+		{"a", "", "a down again"},
+		{"c", "c down", ""},
+	} {
+		if got := <-c; got != want {
+			t.Errorf("got %+v; want %+v", got, want)
+		}
+	}
+	select {
+	case got := <-c:
+		t.Errorf("unexpected extra transition %+v", got)
+	case healthy := <-overall:
+		// Unhealthy before the pause and after it.
+		t.Errorf("unexpected overall event healthy=%v", healthy)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	set("a", nil)
+	if got, want := <-c, (transition{"a", "a down again", ""}); got != want {
+		t.Errorf("after resume: got %+v; want %+v", got, want)
+	}
+	if healthy := <-overall; !healthy {
+		t.Error("after resume: overall unhealthy")
+	}
+}
+
+func TestDERPLatencyRegression(t *testing.T) {
+	resetForTest(t)
+	SetMagicSockDERPHome(1)
+
+	for i := 0; i < 5; i++ {
+		NoteDERPRegionLatency(1, 40*time.Millisecond)
+		NoteDERPRegionLatency(2, 500*time.Millisecond)
+	}
+	if err := get("derp-latency"); err != nil {
+		t.Fatalf("unexpected warning at steady state: %v", err)
+	}
+
+	// A non-home region getting slow doesn't matter.
+	NoteDERPRegionLatency(2, 5*time.Second)
+	if err := get("derp-latency"); err != nil {
+		t.Fatalf("unexpected warning for non-home region: %v", err)
+	}
+
+	NoteDERPRegionLatency(1, 400*time.Millisecond)
+	if err := get("derp-latency"); err == nil {
+		t.Fatal("no warning after home region latency regressed")
+	}
+	NoteDERPRegionLatency(1, 40*time.Millisecond)
+	if err := get("derp-latency"); err != nil {
+		t.Errorf("warning not cleared after latency recovered: %v", err)
+	}
+
+	lat := DERPRegionLatencies()
+	if len(lat) != 2 || lat[1] == 0 || lat[2] == 0 {
+		t.Errorf("DERPRegionLatencies = %v", lat)
+	}
+}
+
+func TestRouteApproval(t *testing.T) {
+	resetForTest(t)
+
+	a := netaddr.MustParseIPPrefix("10.0.0.0/24")
+	b := netaddr.MustParseIPPrefix("192.168.1.0/24")
+	self := netaddr.MustParseIPPrefix("100.101.102.103/32")
+
+	SetRouteApproval([]netaddr.IPPrefix{a, b}, []netaddr.IPPrefix{self, a})
+	err := get("routes-pending-approval")
+	if err == nil {
+		t.Fatal("no warning for unapproved route")
+	}
+	if got, want := err.Error(), "advertised routes awaiting approval in the admin panel: 192.168.1.0/24"; got != want {
+		t.Errorf("warning = %q; want %q", got, want)
+	}
+	if OverallError() != nil {
+		t.Error("pending routes reported as an error, not a warning")
+	}
+
+	SetRouteApproval([]netaddr.IPPrefix{a, b}, []netaddr.IPPrefix{self, a, b})
+	if err := get("routes-pending-approval"); err != nil {
+		t.Errorf("warning not cleared once all routes approved: %v", err)
+	}
+}
+
+func TestRegisterCheck(t *testing.T) {
+	resetForTest(t)
+
+	var (
+		checkMu sync.Mutex
+		failing bool
+	)
+	unregister := RegisterCheck("resolve", func() error {
+		checkMu.Lock()
+		defer checkMu.Unlock()
+		if failing {
+			return errors.New("can't resolve")
+		}
+		return nil
+	})
+	defer unregister()
+
+	got := make(chan error, 10)
+	unwatch := RegisterWatcher(func(key string, err error) {
+		if key == "resolve" {
+			got <- err
+		}
+	})
+	defer unwatch()
+
+	RunChecks()
+	if err := get("resolve"); err != nil {
+		t.Fatalf("after passing check: %v", err)
+	}
+
+	checkMu.Lock()
+	failing = true
+	checkMu.Unlock()
+	RunChecks()
+	if err := get("resolve"); err == nil {
+		t.Fatal("failing check not recorded")
+	}
+	if err := <-got; err == nil {
+		t.Error("watcher not told about failure")
+	}
+
+	checkMu.Lock()
+	failing = false
+	checkMu.Unlock()
+	RunChecks()
+	if err := <-got; err != nil {
+		t.Errorf("watcher told %v; want recovery", err)
+	}
+
+	unregister()
+	checkMu.Lock()
+	failing = true
+	checkMu.Unlock()
+	RunChecks()
+	if err := get("resolve"); err != nil {
+		t.Errorf("unregistered check still run: %v", err)
+	}
+}
+
+func TestSetMany(t *testing.T) {
+	resetForTest(t)
+
+	fired := make(chan string, 10)
+	unwatch := RegisterWatcher(func(key string, _ error) { fired <- key })
+	defer unwatch()
+	overall := make(chan bool, 10)
+	unwatchOverall := RegisterOverallWatcher(func(healthy bool) { overall <- healthy })
+	defer unwatchOverall()
+
+	set("router", errors.New("router down"))
+	if healthy := <-overall; healthy {
+		t.Fatal("overall watcher reported healthy after error")
+	}
+
+	// Fixing router while breaking dns would briefly look healthy
+	// if applied one at a time.
+	SetMany(map[string]error{
+		"router": nil,
+		"dns":    errors.New("dns down"),
+		"routes": nil,
+	})
+	if err := OverallError(); err == nil || err.Error() != "dns: dns down" {
+		t.Errorf("OverallError = %v; want dns down", err)
+	}
+
+	fires := map[string]int{}
+	for i := 0; i < 3; i++ {
+		fires[<-fired]++
+	}
+	if fires["router"] != 2 || fires["dns"] != 1 {
+		t.Errorf("watcher fires = %v; want router twice and dns once", fires)
+	}
+	select {
+	case key := <-fired:
+		t.Errorf("unexpected extra watcher call for %q", key)
+	case healthy := <-overall:
+		t.Errorf("overall watcher fired for batch (healthy=%v)", healthy)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSetPermanent(t *testing.T) {
+	resetForTest(t)
+
+	set("dns", errors.New("dns down"))
+	SetPermanent("firewall", errors.New("access denied"))
+	if got := SeverityOf("firewall"); got != SeverityPermanent {
+		t.Errorf("SeverityOf(firewall) = %v; want %v", got, SeverityPermanent)
+	}
+	const want = "dns: dns down; firewall: access denied (requires action)"
+	if err := OverallError(); err == nil || err.Error() != want {
+		t.Errorf("OverallError = %v; want %q", err, want)
+	}
+
+	SetPermanent("firewall", nil)
+	if got := SeverityOf("firewall"); got != 0 {
+		t.Errorf("SeverityOf(firewall) after clearing = %v; want 0", got)
+	}
+}
+
+func TestBySeverity(t *testing.T) {
+	resetForTest(t)
+
+	if got := BySeverity(); len(got) != 0 {
+		t.Errorf("initially = %v; want empty", got)
+	}
+
+	set("router", errors.New("router down"))
+	set("dns", errors.New("dns down"))
+	set("healthy", nil)
+	SetFirewallSlowWarning(errors.New("slow"))
+	SetCaptivePortal(true)
+	SetPermanent("firewall", errors.New("access denied"))
+	SetPermanent("gone", errors.New("was bad"))
+	SetPermanent("gone", nil)
+
+	got := BySeverity()
+	want := map[Severity][]string{
+		SeverityWarning:   {"captive-portal", "firewall-slow"},
+		SeverityError:     {"dns", "router"},
+		SeverityPermanent: {"firewall"},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("BySeverity = %v; want %v", got, want)
+	}
+}
+
+func TestScore(t *testing.T) {
+	advance := resetForTest(t)
+
+	if got := Score(); got != 50 {
+		t.Errorf("initial Score = %d; want 50 (router and dns unknown, no poll or DERP)", got)
+	}
+
+	SetInPollNetMap(true)
+	if got := Score(); got != 80 {
+		t.Errorf("new map poll: Score = %d; want 80, as it isn't stale yet", got)
+	}
+	GotStreamedMapResponse()
+	SetMagicSockDERPHome(1)
+	if got := Score(); got != 80 {
+		t.Errorf("home DERP set but disconnected: Score = %d; want 80", got)
+	}
+	SetDERPRegionConnectedState(2, true)
+	if got := Score(); got != 80 {
+		t.Errorf("connected to a DERP region other than home: Score = %d; want 80", got)
+	}
+	SetDERPRegionConnectedState(1, true)
+	if got := Score(); got != 100 {
+		t.Errorf("all healthy: Score = %d; want 100", got)
+	}
+
+	SetMagicDNSHealth(errors.New("no answer"))
+	if got := Score(); got != 80 {
+		t.Errorf("MagicDNS down: Score = %d; want 80", got)
+	}
+	SetRouterHealth(errors.New("boom"))
+	if got := Score(); got != 50 {
+		t.Errorf("router and MagicDNS down: Score = %d; want 50", got)
+	}
+
+	advance(mapPollStaleAfter)
+	if got := Score(); got != 20 {
+		t.Errorf("stale map poll: Score = %d; want 20", got)
+	}
+	SetDERPRegionConnectedState(1, false)
+	if got := Score(); got != 0 {
+		t.Errorf("nothing healthy: Score = %d; want 0", got)
+	}
+}
+
+func TestKeyExpiry(t *testing.T) {
+	advance := resetForTest(t)
+
+	SetKeyExpiry(timeNow().Add(48 * time.Hour))
+	if err := get("key-expiry"); err != nil {
+		t.Fatalf("two days out: %v", err)
+	}
+
+	advance(25 * time.Hour)
+	RunChecks()
+	if err := get("key-expiry"); err == nil {
+		t.Fatal("no warning within a day of expiry")
+	} else if got, want := err.Error(), "node key expires in 23h0m0s"; got != want {
+		t.Errorf("warning = %q; want %q", got, want)
+	}
+	if sev := SeverityOf("key-expiry"); sev != SeverityWarning {
+		t.Errorf("severity = %v; want %v", sev, SeverityWarning)
+	}
+	if err := OverallError(); err != nil {
+		t.Errorf("OverallError before expiry = %v; want nil", err)
+	}
+
+	advance(23 * time.Hour)
+	RunChecks()
+	if sev := SeverityOf("key-expiry"); sev != SeverityError {
+		t.Errorf("severity after expiry = %v; want %v", sev, SeverityError)
+	}
+	if err := OverallError(); err == nil {
+		t.Error("OverallError after expiry = nil")
+	}
+
+	SetKeyExpiry(timeNow().Add(90 * 24 * time.Hour))
+	if err := get("key-expiry"); err != nil {
+		t.Errorf("after new key: %v", err)
+	}
+	SetKeyExpiry(time.Time{})
+	if err := get("key-expiry"); err != nil {
+		t.Errorf("without expiry: %v", err)
+	}
+}
+
+func TestKeyExpiryErrorWatcher(t *testing.T) {
+	advance := resetForTest(t)
+
+	c := make(chan error, 10)
+	unregister := RegisterSeverityWatcher(SeverityError, func(key string, _, newErr error) {
+		if key == "key-expiry" {
+			c <- newErr
+		}
+	})
+	defer unregister()
+
+	SetKeyExpiry(timeNow().Add(time.Hour))
+	advance(2 * time.Hour)
+	RunChecks()
+	select {
+	case err := <-c:
+		if err == nil || !strings.Contains(err.Error(), "expired") {
+			t.Errorf("watcher got %v; want the expiry error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("error watcher not told the key expired")
+	}
+	select {
+	case err := <-c:
+		t.Errorf("unexpected extra event %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSetKeepsIdenticalError(t *testing.T) {
+	resetForTest(t)
+
+	first := errors.New("boom")
+	set("test", first)
+	set("test", errors.New("boom"))
+	if got := m["test"].err; got != first {
+		t.Errorf("identical error replaced the stored one")
+	}
+	set("test", errors.New("bang"))
+	if got := get("test"); got == nil || got.Error() != "bang" {
+		t.Errorf("get = %v; want bang", got)
+	}
+}
+
+func BenchmarkSetSameError(b *testing.B) {
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(m, "bench")
+	}()
+	set("bench", errors.New("boom"))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		set("bench", fmt.Errorf("boom"))
+	}
+}
+
+func TestSeverityWatcher(t *testing.T) {
+	resetForTest(t)
+
+	type event struct {
+		key       string
+		unhealthy bool
+	}
+	watch := func(min Severity) (<-chan event, func()) {
+		c := make(chan event, 10)
+		unregister := RegisterSeverityWatcher(min, func(key string, _, newErr error) {
+			c <- event{key, newErr != nil}
+		})
+		return c, unregister
+	}
+	all, unregAll := watch(0)
+	defer unregAll()
+	errs, unregErrs := watch(SeverityError)
+	defer unregErrs()
+	perms, unregPerms := watch(SeverityPermanent)
+	defer unregPerms()
+
+	SetFirewallSlowWarning(errors.New("slow"))
+	SetFirewallSlowWarning(nil)
+	set("router", errors.New("down"))
+	set("router", nil)
+	SetPermanent("firewall", errors.New("access denied"))
+	SetPermanent("firewall", nil)
+
+	collect := func(c <-chan event, n int) []event {
+		var got []event
+		for i := 0; i < n; i++ {
+			got = append(got, <-c)
+		}
+		select {
+		case e := <-c:
+			t.Errorf("unexpected extra event %+v", e)
+		case <-time.After(50 * time.Millisecond):
+		}
+		return got
+	}
+	tests := []struct {
+		name string
+		c    <-chan event
+		want []event
+	}{
+		{"all", all, []event{
+			{"firewall-slow", true}, {"firewall-slow", false},
+			{"router", true}, {"router", false},
+			{"firewall", true}, {"firewall", false},
+		}},
+		{"errors", errs, []event{
+			{"router", true}, {"router", false},
+			{"firewall", true}, {"firewall", false},
+		}},
+		{"permanent", perms, []event{
+			{"firewall", true}, {"firewall", false},
+		}},
+	}
+	for _, tt := range tests {
+		got := collect(tt.c, len(tt.want))
+		for i := range tt.want {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: event %d = %+v; want %+v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestSeverityWatcherCrossing(t *testing.T) {
+	resetForTest(t)
+
+	type event struct{ old, new string }
+	errStr := func(err error) string {
+		if err == nil {
+			return ""
+		}
+		return err.Error()
+	}
+	c := make(chan event, 10)
+	unregister := RegisterSeverityWatcher(SeverityError, func(key string, oldErr, newErr error) {
+		c <- event{errStr(oldErr), errStr(newErr)}
+	})
+	defer unregister()
+	expect := func(what string, want ...event) {
+		t.Helper()
+		for _, w := range want {
+			select {
+			case got := <-c:
+				if got != w {
+					t.Errorf("%s: got %+v; want %+v", what, got, w)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: no event; want %+v", what, w)
+			}
+		}
+		select {
+		case got := <-c:
+			t.Errorf("%s: unexpected extra event %+v", what, got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	setSeverity("k", errors.New("w"), SeverityWarning)
+	expect("warning")
+	setSeverity("k", errors.New("e"), SeverityError)
+	expect("warning to error", event{"", "e"})
+	setSeverity("k", errors.New("w"), SeverityWarning)
+	expect("error to warning", event{"e", ""})
+	setSeverity("k", nil, SeverityWarning)
+	expect("warning to healthy")
+
+	setSeverity("k", errors.New("e"), SeverityError)
+	expect("healthy to error", event{"", "e"})
+	setSeverity("k", errors.New("w"), SeverityWarning)
+	setSeverity("k", nil, SeverityWarning)
+	expect("error to warning to healthy", event{"e", ""})
+}
+
+func TestInPollNetMapReason(t *testing.T) {
+	resetForTest(t)
+
+	SetInPollNetMap(true)
+	SetInPollNetMap(false)
+	if err := get("map-poll"); err != nil {
+		t.Errorf("after normal end: %v", err)
+	}
+
+	SetInPollNetMap(true)
+	SetInPollNetMapReason(false, errors.New("connection reset"))
+	if err := get("map-poll"); err == nil {
+		t.Fatal("no error after abnormal end")
+	} else if got, want := err.Error(), "map poll ended: connection reset"; got != want {
+		t.Errorf("error = %q; want %q", got, want)
+	}
+	if err := OverallError(); err == nil {
+		t.Error("OverallError after abnormal end = nil")
+	}
+	// The client notes it's not in a poll before retrying; the
+	// error stays until a poll delivers a netmap.
+	SetInPollNetMap(false)
+	if err := get("map-poll"); err == nil {
+		t.Error("error cleared while backing off before the next poll")
+	}
+
+	SetInPollNetMap(true)
+	if err := get("map-poll"); err != nil {
+		t.Errorf("after new poll: %v", err)
+	}
+
+	SetInPollNetMapReason(false, errors.New("EOF"))
+	SetInPollNetMapReason(false, nil)
+	if err := get("map-poll"); err != nil {
+		t.Errorf("after normal end following error: %v", err)
+	}
+}
+
+func TestNATType(t *testing.T) {
+	resetForTest(t)
+
+	mr := func(hard opt.Bool) *tailcfg.MapRequest {
+		return &tailcfg.MapRequest{
+			Hostinfo: &tailcfg.Hostinfo{
+				NetInfo: &tailcfg.NetInfo{MappingVariesByDestIP: hard},
+			},
+		}
+	}
+
+	NoteMapRequestHeard(&tailcfg.MapRequest{})
+	NoteMapRequestHeard(mr(""))
+	if err := get("nat-type"); err != nil {
+		t.Errorf("without NAT info: %v", err)
+	}
+
+	NoteMapRequestHeard(mr("true"))
+	if err := get("nat-type"); err == nil {
+		t.Fatal("no warning for hard NAT")
+	}
+	if sev := SeverityOf("nat-type"); sev != SeverityWarning {
+		t.Errorf("severity = %v; want %v", sev, SeverityWarning)
+	}
+	if err := OverallError(); err != nil {
+		t.Errorf("OverallError with hard NAT = %v; want nil", err)
+	}
+
+	NoteMapRequestHeard(mr(""))
+	if err := get("nat-type"); err == nil {
+		t.Error("warning cleared while NAT type unknown")
+	}
+
+	NoteMapRequestHeard(mr("false"))
+	if err := get("nat-type"); err != nil {
+		t.Errorf("after re-probe found easy NAT: %v", err)
+	}
+}
+
+func TestPeerCount(t *testing.T) {
+	resetForTest(t)
+
+	SetPeerCount(0)
+	if err := get("no-peers"); err != nil {
+		t.Errorf("node that never had peers: %v", err)
+	}
+
+	SetPeerCount(3)
+	if err := get("no-peers"); err != nil {
+		t.Errorf("with peers: %v", err)
+	}
+
+	SetPeerCount(0)
+	if err := get("no-peers"); err == nil {
+		t.Fatal("no warning after peers dropped to zero")
+	}
+	if sev := SeverityOf("no-peers"); sev != SeverityWarning {
+		t.Errorf("severity = %v; want %v", sev, SeverityWarning)
+	}
+	if err := OverallError(); err != nil {
+		t.Errorf("OverallError with no peers = %v; want nil", err)
+	}
+
+	SetPeerCount(1)
+	if err := get("no-peers"); err != nil {
+		t.Errorf("after peers returned: %v", err)
+	}
+}
+
+func TestDERPHomeMismatch(t *testing.T) {
+	resetForTest(t)
+
+	advertise := func(region int) {
+		NoteMapRequestHeard(&tailcfg.MapRequest{
+			Hostinfo: &tailcfg.Hostinfo{
+				NetInfo: &tailcfg.NetInfo{PreferredDERP: region},
+			},
+		})
+	}
+
+	SetMagicSockDERPHome(1)
+	if err := get("derp-home"); err != nil {
+		t.Fatalf("before anything was advertised: %v", err)
+	}
+	advertise(1)
+	if err := get("derp-home"); err != nil {
+		t.Fatalf("matching: %v", err)
+	}
+
+	// magicsock moves first; the next map request catches up.
+	SetMagicSockDERPHome(2)
+	if err := get("derp-home"); err == nil {
+		t.Fatal("no warning after magicsock moved home")
+	}
+	if sev := SeverityOf("derp-home"); sev != SeverityWarning {
+		t.Errorf("severity = %v; want %v", sev, SeverityWarning)
+	}
+	advertise(2)
+	if err := get("derp-home"); err != nil {
+		t.Errorf("after control was told: %v", err)
+	}
+
+	// control is told something else; magicsock returning to what
+	// was advertised clears it without another map request.
+	advertise(3)
+	if err := get("derp-home"); err == nil {
+		t.Fatal("no warning after advertising another region")
+	}
+	SetMagicSockDERPHome(3)
+	if err := get("derp-home"); err != nil {
+		t.Errorf("after magicsock matched: %v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	resetForTest(t)
+
+	type change struct {
+		key    string
+		newErr error
+	}
+	changes := make(chan change, 10)
+	defer RegisterTransitionWatcher(func(key string, _, newErr error) {
+		changes <- change{key, newErr}
+	})()
+	overall := make(chan bool, 10)
+	defer RegisterOverallWatcher(func(healthy bool) { overall <- healthy })()
+
+	SetRouterHealth(errors.New("boom"))
+	SetDNSUpstreamWarning(errors.New("slow"))
+	SetMagicDNSHealth(nil)
+	SetInfo("os", "plan9")
+	SetInPollNetMap(true)
+	SetMagicSockDERPHome(1)
+	for i := 0; i < 2; i++ {
+		<-changes
+	}
+	if healthy := <-overall; healthy {
+		t.Fatal("overall watcher reported healthy after error")
+	}
+
+	Reset()
+	got := map[string]error{}
+	for i := 0; i < 2; i++ {
+		c := <-changes
+		got[c.key] = c.newErr
+	}
+	for _, key := range []string{"router", "dns-upstream"} {
+		if err, ok := got[key]; !ok || err != nil {
+			t.Errorf("Reset notified %q = %v, %v; want nil, true", key, err, ok)
+		}
+	}
+	if healthy := <-overall; !healthy {
+		t.Error("overall watcher not told healthy after Reset")
+	}
+
+	if err := OverallError(); err != nil {
+		t.Errorf("OverallError after Reset = %v", err)
+	}
+	if len(Info()) != 0 {
+		t.Errorf("Info after Reset = %v", Info())
+	}
+	if d := Diagnostics(timeNow()); d != (DiagInfo{}) {
+		t.Errorf("Diagnostics after Reset = %+v; want zero", d)
+	}
+	if !LastChange("router").IsZero() {
+		t.Error("router entry kept after Reset")
+	}
+
+	// Watchers stay registered.
+	SetRouterHealth(errors.New("again"))
+	if c := <-changes; c.key != "router" || c.newErr == nil {
+		t.Errorf("after Reset, watcher got %+v", c)
+	}
+}
+
+func TestStateStoreHealth(t *testing.T) {
+	resetForTest(t)
+
+	type change struct {
+		key    string
+		oldErr error
+		newErr error
+	}
+	changes := make(chan change, 10)
+	defer RegisterTransitionWatcher(func(key string, oldErr, newErr error) {
+		changes <- change{key, oldErr, newErr}
+	})()
+
+	SetStateStoreHealth(nil)
+	errDiskFull := errors.New("write tailscaled.state: no space left on device")
+	SetStateStoreHealth(errDiskFull)
+	if err := StateStoreHealth(); err != errDiskFull {
+		t.Errorf("StateStoreHealth = %v; want %v", err, errDiskFull)
+	}
+	if c := <-changes; c.key != "state-store" || c.oldErr != nil || c.newErr != errDiskFull {
+		t.Errorf("on failure, watcher got %+v", c)
+	}
+	if err := OverallError(); err == nil {
+		t.Error("OverallError = nil while state store failing")
+	}
+
+	SetStateStoreHealth(nil)
+	if err := StateStoreHealth(); err != nil {
+		t.Errorf("after successful write: %v", err)
+	}
+	if c := <-changes; c.key != "state-store" || c.oldErr != errDiskFull || c.newErr != nil {
+		t.Errorf("on recovery, watcher got %+v", c)
+	}
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected change %+v", c)
+	default:
+	}
+}
+
+func TestSetExitNode(t *testing.T) {
+	resetForTest(t)
+
+	SetExitNode("home-pi", "nStableID1")
+	got := Info()
+	if got["exit-node"] != "home-pi" || got["exit-node-id"] != "nStableID1" {
+		t.Errorf("Info with exit node = %v", got)
+	}
+	if err := OverallError(); err != nil {
+		t.Errorf("OverallError with exit node = %v; want nil", err)
+	}
+
+	SetExitNode("", "")
+	got = Info()
+	if _, ok := got["exit-node"]; ok {
+		t.Errorf("exit-node not cleared: %v", got)
+	}
+	if _, ok := got["exit-node-id"]; ok {
+		t.Errorf("exit-node-id not cleared: %v", got)
+	}
+}
+
+func TestNodeExpired(t *testing.T) {
+	resetForTest(t)
+
+	SetNodeExpired(false)
+	if _, ok := m["node-expired"]; ok {
+		t.Error("clearing an unset node-expired created the key")
+	}
+
+	SetNodeExpired(true)
+	if err := get("node-expired"); err == nil {
+		t.Fatal("node-expired not set")
+	}
+	if got := SeverityOf("node-expired"); got != SeverityError {
+		t.Errorf("severity = %v; want error", got)
+	}
+	if hint := Hint("node-expired"); !strings.Contains(hint, "tailscale up") {
+		t.Errorf("hint = %q; want one saying how to re-authenticate", hint)
+	}
+	if got, _ := OfflineReason(); got != "this device's login has expired; log in again" {
+		t.Errorf("OfflineReason = %q", got)
+	}
+
+	SetNodeExpired(false)
+	if err := get("node-expired"); err != nil {
+		t.Errorf("after re-authenticating: %v", err)
+	}
+	if hint := Hint("node-expired"); hint != "" {
+		t.Errorf("hint = %q after re-authenticating; want empty", hint)
+	}
+}
+
+func TestSetTailnet(t *testing.T) {
+	resetForTest(t)
+
+	SetTailnet("example.com")
+	if got := Info()["tailnet"]; got != "example.com" {
+		t.Errorf("tailnet = %q; want %q", got, "example.com")
+	}
+	if err := OverallError(); err != nil {
+		t.Errorf("OverallError with tailnet = %v; want nil", err)
+	}
+
+	SetTailnet("")
+	if got, ok := Info()["tailnet"]; ok {
+		t.Errorf("tailnet not cleared on logout: %q", got)
+	}
+}
+
+func TestUpdateAvailable(t *testing.T) {
+	resetForTest(t)
+
+	SetUpdateAvailable("1.6.0", "1.6.0")
+	if err := get("update-available"); err != nil {
+		t.Errorf("up to date: %v", err)
+	}
+	if v, ok := Info()["update-available"]; ok {
+		t.Errorf("up to date: info = %q; want none", v)
+	}
+
+	SetUpdateAvailable("1.4.2", "1.6.0")
+	if err := get("update-available"); err == nil {
+		t.Fatal("no warning when outdated")
+	}
+	if sev := SeverityOf("update-available"); sev != SeverityWarning {
+		t.Errorf("severity = %v; want %v", sev, SeverityWarning)
+	}
+	if got := Info()["update-available"]; got != "1.6.0" {
+		t.Errorf("info = %q; want %q", got, "1.6.0")
+	}
+
+	SetUpdateAvailable("1.4.2", "")
+	if err := get("update-available"); err != nil {
+		t.Errorf("latest unknown: %v", err)
+	}
+
+	SetUpdateAvailable("1.4.2", "1.6.0")
+	SetUpdateAvailable("1.6.0", "1.6.0")
+	if err := get("update-available"); err != nil {
+		t.Errorf("after update: %v", err)
+	}
+	if v, ok := Info()["update-available"]; ok {
+		t.Errorf("after update: info = %q; want none", v)
+	}
+}
+
+func TestThrottledWatcher(t *testing.T) {
+	advance := resetForTest(t)
+	sleeps := make(chan time.Duration)
+	wake := make(chan bool)
+	mu.Lock()
+	timeSleep = func(d time.Duration) {
+		sleeps <- d
+		<-wake
+	}
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		timeSleep = time.Sleep
+	})
+
+	type change struct {
+		key            string
+		oldErr, newErr error
+	}
+	changes := make(chan change, 10)
+	defer RegisterThrottledWatcher(10*time.Second, func(key string, oldErr, newErr error) {
+		changes <- change{key, oldErr, newErr}
+	})()
+
+	// The first transition is delivered right away.
+	err1 := errors.New("one")
+	SetRouterHealth(err1)
+	if c := <-changes; c != (change{"router", nil, err1}) {
+		t.Fatalf("first delivery = %+v", c)
+	}
+
+	// A storm within the interval waits for it to elapse, then is
+	// delivered coalesced.
+	err2 := errors.New("two")
+	errDNS := errors.New("dns")
+	SetRouterHealth(nil)
+	SetMagicDNSHealth(errDNS)
+	SetRouterHealth(err2)
+	SetTUNHealth(errors.New("gone"))
+	SetTUNHealth(nil)
+	if d := <-sleeps; d != 10*time.Second {
+		t.Errorf("waited %v; want 10s", d)
+	}
+	select {
+	case c := <-changes:
+		t.Fatalf("delivered %+v before the interval elapsed", c)
+	default:
+	}
+	advance(10 * time.Second)
+	wake <- true
+
+	want := []change{
+		{"router", err1, err2},
+		{"magicdns", nil, errDNS},
+	}
+	for i, w := range want {
+		if c := <-changes; c != w {
+			t.Errorf("coalesced delivery %d = %+v; want %+v", i, c, w)
+		}
+	}
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected delivery %+v", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConnectedDERPRegions(t *testing.T) {
+	resetForTest(t)
+
+	if got := ConnectedDERPRegions(); len(got) != 0 {
+		t.Errorf("initially = %v; want none", got)
+	}
+	SetDERPRegionConnectedState(10, true)
+	SetDERPRegionConnectedState(2, true)
+	SetDERPRegionConnectedState(5, true)
+	SetDERPRegionConnectedState(2, true)
+	SetDERPRegionConnectedState(5, false)
+	got := ConnectedDERPRegions()
+	if want := []int{2, 10}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ConnectedDERPRegions = %v; want %v", got, want)
+	}
+	got[0] = 99
+	if again := ConnectedDERPRegions(); again[0] != 2 {
+		t.Errorf("ConnectedDERPRegions returned shared slice: %v", again)
+	}
+}
+
+func TestDERPRegionConnectedSince(t *testing.T) {
+	advance := resetForTest(t)
+
+	t0 := timeNow()
+	SetDERPRegionConnectedState(1, true)
+	SetDERPRegionConnectedState(2, true)
+	advance(time.Minute)
+	SetDERPRegionConnectedState(1, true) // still the same connection
+	got := DERPRegionConnectedSince()
+	if len(got) != 2 || !got[1].Equal(t0) || !got[2].Equal(t0) {
+		t.Fatalf("DERPRegionConnectedSince = %v; want regions 1 and 2 since %v", got, t0)
+	}
+
+	SetDERPRegionConnectedState(2, false)
+	advance(time.Minute)
+	SetDERPRegionConnectedState(2, true)
+	got = DERPRegionConnectedSince()
+	if !got[1].Equal(t0) {
+		t.Errorf("region 1 since %v; want %v", got[1], t0)
+	}
+	if want := t0.Add(2 * time.Minute); !got[2].Equal(want) {
+		t.Errorf("region 2 since %v after reconnecting; want %v", got[2], want)
+	}
+
+	SetDERPRegionConnectedState(1, false)
+	if _, ok := DERPRegionConnectedSince()[1]; ok {
+		t.Error("disconnected region 1 still reported")
+	}
+}
+
+func TestRegisterOnce(t *testing.T) {
+	resetForTest(t)
+
+	got := make(chan error, 10)
+	RegisterOnce("router", func(err error) { got <- err })
+
+	errBoom := errors.New("boom")
+	SetMagicDNSHealth(errors.New("other key"))
+	SetRouterHealth(errBoom)
+	SetRouterHealth(nil)
+	if err := <-got; err != errBoom {
+		t.Errorf("RegisterOnce got %v; want %v", err, errBoom)
+	}
+	select {
+	case err := <-got:
+		t.Errorf("called again with %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	mu.Lock()
+	n := len(watchers)
+	mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d watchers still registered; want 0", n)
+	}
+
+	unregister := RegisterOnce("router", func(err error) { got <- err })
+	unregister()
+	SetRouterHealth(errBoom)
+	select {
+	case err := <-got:
+		t.Errorf("called after unregister with %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLocalAPIHealth(t *testing.T) {
+	resetForTest(t)
+
+	SetLocalAPIHealth(nil)
+	if err := LocalAPIHealth(); err != nil {
+		t.Errorf("initially: %v", err)
+	}
+	errBind := errors.New("safesocket.Listen: bind: address already in use")
+	SetLocalAPIHealth(errBind)
+	if err := LocalAPIHealth(); err != errBind {
+		t.Errorf("after bind failure = %v; want %v", err, errBind)
+	}
+	if err := OverallError(); err == nil {
+		t.Error("OverallError = nil while local API is down")
+	}
+	SetLocalAPIHealth(nil)
+	if err := LocalAPIHealth(); err != nil {
+		t.Errorf("after recovery: %v", err)
+	}
+	if err := OverallError(); err != nil {
+		t.Errorf("OverallError after recovery = %v", err)
+	}
+}
+
+func TestMapResponseStale(t *testing.T) {
+	advance := resetForTest(t)
+
+	SetInPollNetMap(true)
+	advance(defaultMapPollStaleAfter - time.Second)
+	RunChecks()
+	if err := get("map-response"); err != nil {
+		t.Fatalf("just under default threshold: %v", err)
+	}
+	advance(time.Second)
+	RunChecks()
+	if err := get("map-response"); err == nil {
+		t.Fatal("no error at default threshold")
+	} else if got, want := err.Error(), "no map response from control in over 2m0s"; got != want {
+		t.Errorf("error = %q; want %q", got, want)
+	}
+
+	GotStreamedMapResponse()
+	if err := get("map-response"); err != nil {
+		t.Fatalf("after response: %v", err)
+	}
+
+	// A control server with rarer keep-alives.
+	SetMapResponseStaleThreshold(5 * time.Minute)
+	advance(5*time.Minute - time.Second)
+	RunChecks()
+	if err := get("map-response"); err != nil {
+		t.Errorf("just under 5m threshold: %v", err)
+	}
+	if got := Score(); got < scoreMapPoll {
+		t.Errorf("Score = %d; want map poll counted", got)
+	}
+	advance(time.Second)
+	RunChecks()
+	if err := get("map-response"); err == nil {
+		t.Error("no error at 5m threshold")
+	}
+
+	// Shortening the threshold takes effect right away.
+	GotStreamedMapResponse()
+	advance(time.Minute)
+	SetMapResponseStaleThreshold(30 * time.Second)
+	if err := get("map-response"); err == nil {
+		t.Error("no error after lowering threshold below silence")
+	}
+
+	SetInPollNetMap(false)
+	if err := get("map-response"); err != nil {
+		t.Errorf("after poll ended: %v", err)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"golang.org/x/oauth2"
 	"inet.af/netaddr"
 	"tailscale.com/control/controlclient"
+	"tailscale.com/health"
 	"tailscale.com/internal/deepprint"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
@@ -334,7 +335,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	// Now complete the lock-free parts of what we started while locked.
 	if prefsChanged {
 		if stateKey != "" {
-			if err := b.store.WriteState(stateKey, prefs.ToBytes()); err != nil {
+			if err := b.writeState(stateKey, prefs.ToBytes()); err != nil {
 				b.logf("Failed to save new controlclient state: %v", err)
 			}
 		}
@@ -371,6 +372,21 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	b.authReconfig()
 }
 
+// exitNodeName returns the display name of the peer in nm with the
+// given stable ID, or the ID itself if nm has no such peer. It returns
+// the empty string if id is empty.
+func exitNodeName(nm *netmap.NetworkMap, id tailcfg.StableNodeID) string {
+	if id == "" {
+		return ""
+	}
+	for _, p := range nm.Peers {
+		if p.StableID == id && p.ComputedName != "" {
+			return p.ComputedName
+		}
+	}
+	return string(id)
+}
+
 // findExitNodeIDLocked updates b.prefs to reference an exit node by ID,
 // rather than by IP. It returns whether prefs was mutated.
 func (b *LocalBackend) findExitNodeIDLocked(nm *netmap.NetworkMap) (prefsChanged bool) {
@@ -841,7 +857,7 @@ func (b *LocalBackend) initMachineKeyLocked() (err error) {
 	}
 
 	keyText, _ = b.machinePrivKey.MarshalText()
-	if err := b.store.WriteState(ipn.MachineKeyStateKey, keyText); err != nil {
+	if err := b.writeState(ipn.MachineKeyStateKey, keyText); err != nil {
 		b.logf("error writing machine key to store: %v", err)
 		return err
 	}
@@ -850,6 +866,14 @@ func (b *LocalBackend) initMachineKeyLocked() (err error) {
 	return nil
 }
 
+// writeState writes bs to the state store under key, and reports to
+// health whether the store is working.
+func (b *LocalBackend) writeState(key ipn.StateKey, bs []byte) error {
+	err := b.store.WriteState(key, bs)
+	health.SetStateStoreHealth(err)
+	return err
+}
+
 // writeServerModeStartState stores the ServerModeStartKey value based on the current
 // user and prefs. If userID is blank or prefs is blank, no work is done.
 //
@@ -861,7 +885,7 @@ func (b *LocalBackend) writeServerModeStartState(userID string, prefs *ipn.Prefs
 
 	if prefs.ForceDaemon {
 		stateKey := ipn.StateKey("user-" + userID)
-		if err := b.store.WriteState(ipn.ServerModeStartKey, []byte(stateKey)); err != nil {
+		if err := b.writeState(ipn.ServerModeStartKey, []byte(stateKey)); err != nil {
 			b.logf("WriteState error: %v", err)
 		}
 		// It's important we do this here too, even if it looks
@@ -869,11 +893,11 @@ func (b *LocalBackend) writeServerModeStartState(userID string, prefs *ipn.Prefs
 		// check block above. That one won't fire in the case
 		// where the Windows client started up in client mode.
 		// This happens when we transition into server mode:
-		if err := b.store.WriteState(stateKey, prefs.ToBytes()); err != nil {
+		if err := b.writeState(stateKey, prefs.ToBytes()); err != nil {
 			b.logf("WriteState error: %v", err)
 		}
 	} else {
-		if err := b.store.WriteState(ipn.ServerModeStartKey, nil); err != nil {
+		if err := b.writeState(ipn.ServerModeStartKey, nil); err != nil {
 			b.logf("WriteState error: %v", err)
 		}
 	}
@@ -916,7 +940,7 @@ func (b *LocalBackend) loadStateLocked(key ipn.StateKey, prefs *ipn.Prefs, legac
 		// Backend owns the state, but frontend is trying to migrate
 		// state into the backend.
 		b.logf("importing frontend prefs into backend store; frontend prefs: %s", prefs.Pretty())
-		if err := b.store.WriteState(key, prefs.ToBytes()); err != nil {
+		if err := b.writeState(key, prefs.ToBytes()); err != nil {
 			return fmt.Errorf("store.WriteState: %v", err)
 		}
 	}
@@ -1137,7 +1161,7 @@ func (b *LocalBackend) SetPrefs(newp *ipn.Prefs) {
 	b.mu.Unlock()
 
 	if stateKey != "" {
-		if err := b.store.WriteState(stateKey, newp.ToBytes()); err != nil {
+		if err := b.writeState(stateKey, newp.ToBytes()); err != nil {
 			b.logf("Failed to save new controlclient state: %v", err)
 		}
 	}
@@ -1243,6 +1267,7 @@ func (b *LocalBackend) authReconfig() {
 		b.logf("authReconfig: skipping because !WantRunning.")
 		return
 	}
+	health.SetExitNode(exitNodeName(nm, uc.ExitNodeID), string(uc.ExitNodeID))
 
 	var flags netmap.WGConfigFlags
 	if uc.RouteAll {
@@ -1599,9 +1624,18 @@ func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap) {
 
 	if nm == nil {
 		b.nodeByAddr = nil
+		health.SetKeyExpiry(time.Time{})
+		health.SetTailnet("")
 		return
 	}
 
+	if nm.SelfNode != nil && b.prefs != nil {
+		health.SetRouteApproval(b.prefs.AdvertiseRoutes, nm.SelfNode.AllowedIPs)
+	}
+	health.SetKeyExpiry(nm.Expiry)
+	health.SetPeerCount(len(nm.Peers))
+	health.SetTailnet(nm.Domain)
+
 	// Update the nodeByAddr index.
 	if b.nodeByAddr == nil {
 		b.nodeByAddr = map[netaddr.IP]*tailcfg.Node{}
@@ -29,6 +29,7 @@ import (
 	"inet.af/netaddr"
 	"inet.af/peercred"
 	"tailscale.com/control/controlclient"
+	"tailscale.com/health"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/localapi"
@@ -569,8 +570,11 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 
 	listen, _, err := safesocket.Listen(opts.SocketPath, uint16(opts.Port))
 	if err != nil {
-		return fmt.Errorf("safesocket.Listen: %v", err)
+		err = fmt.Errorf("safesocket.Listen: %v", err)
+		health.SetLocalAPIHealth(err)
+		return err
 	}
+	health.SetLocalAPIHealth(nil)
 
 	server := &server{
 		logf:        logf,
@@ -739,10 +743,12 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 		if err != nil {
 			if ctx.Err() == nil {
 				logf("ipnserver: Accept: %v", err)
+				health.SetLocalAPIHealth(fmt.Errorf("accept: %v", err))
 				bo.BackOff(ctx, err)
 			}
 			continue
 		}
+		health.SetLocalAPIHealth(nil)
 		go server.serveConn(ctx, c, logger.WithPrefix(logf, fmt.Sprintf("ipnserver: conn%d: ", i)))
 	}
 	return ctx.Err()
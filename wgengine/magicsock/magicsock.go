@@ -37,6 +37,7 @@ import (
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/disco"
+	"tailscale.com/health"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/dnscache"
@@ -650,6 +651,9 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 
 	c.noV4.Set(!report.IPv4)
 	c.noV6.Set(!report.IPv6)
+	for rid, d := range report.RegionLatency {
+		health.NoteDERPRegionLatency(rid, d)
+	}
 
 	ni := &tailcfg.NetInfo{
 		DERPLatency:           map[string]float64{},
@@ -943,6 +947,7 @@ func (c *Conn) setNearestDERP(derpNum int) (wantDERP bool) {
 	defer c.mu.Unlock()
 	if !c.wantDerpLocked() {
 		c.myDerp = 0
+		health.SetMagicSockDERPHome(0)
 		return false
 	}
 	if derpNum == c.myDerp {
@@ -950,6 +955,7 @@ func (c *Conn) setNearestDERP(derpNum int) (wantDERP bool) {
 		return true
 	}
 	c.myDerp = derpNum
+	health.SetMagicSockDERPHome(derpNum)
 
 	if c.privateKey.IsZero() {
 		// No private key yet, so DERP connections won't come up anyway.
@@ -1411,8 +1417,18 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 	// connection, based on messages we've received from the server.
 	peerPresent := map[key.Public]bool{}
 	bo := backoff.NewBackoff(fmt.Sprintf("derp-%d", regionID), c.logf, 5*time.Second)
+	connected := false // as last reported to health
+	defer func() {
+		if connected {
+			health.SetDERPRegionConnectedState(regionID, false)
+		}
+	}()
 	for {
 		msg, err := dc.Recv()
+		if connected != (err == nil) {
+			connected = err == nil
+			health.SetDERPRegionConnectedState(regionID, connected)
+		}
 		if err != nil {
 			// Forget that all these peers have routes.
 			for peer := range peerPresent {
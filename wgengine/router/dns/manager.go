@@ -31,6 +31,14 @@ type managerImpl interface {
 	Down() error
 }
 
+// verifier is implemented by managerImpls that can check the OS DNS
+// settings still match what Up applied.
+type verifier interface {
+	// Verify returns an error describing how the OS DNS settings
+	// differ from config, or nil if they match.
+	Verify(config Config) error
+}
+
 // Manager manages system DNS settings.
 type Manager struct {
 	logf logger.Logf
@@ -39,6 +47,10 @@ type Manager struct {
 
 	config  Config
 	mconfig ManagerConfig
+	// dirty is whether the last Set failed or Down was called since,
+	// so the OS state may not match config and the next Set must
+	// apply even if it's equal.
+	dirty bool
 }
 
 // NewManagers created a new manager from the given config.
@@ -56,10 +68,11 @@ func NewManager(mconfig ManagerConfig) *Manager {
 	return m
 }
 
-func (m *Manager) Set(config Config) error {
-	if config.Equal(m.config) {
+func (m *Manager) Set(config Config) (err error) {
+	if !m.dirty && config.Equal(m.config) {
 		return nil
 	}
+	defer func() { m.dirty = err != nil }()
 
 	m.logf("Set: %+v", config)
 
@@ -82,7 +95,7 @@ func (m *Manager) Set(config Config) error {
 		m.logf("switched to %T", m.impl)
 	}
 
-	err := m.impl.Up(config)
+	err = m.impl.Up(config)
 	// If we save the config, we will not retry next time. Only do this on success.
 	if err == nil {
 		m.config = config
@@ -91,10 +104,28 @@ func (m *Manager) Set(config Config) error {
 	return err
 }
 
+// Verify returns an error if the OS DNS settings no longer match the
+// config applied by the last Set, because something else changed them.
+// It returns nil if they match, if the manager can't tell, or if the
+// last Set didn't succeed.
+func (m *Manager) Verify() error {
+	v, ok := m.impl.(verifier)
+	if !ok || m.dirty {
+		return nil
+	}
+	config := m.config
+	if len(config.Nameservers) == 0 {
+		// Set took DNS down instead.
+		config = Config{}
+	}
+	return v.Verify(config)
+}
+
 func (m *Manager) Up() error {
 	return m.impl.Up(m.config)
 }
 
 func (m *Manager) Down() error {
+	m.dirty = true
 	return m.impl.Down()
 }
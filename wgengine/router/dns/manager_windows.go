@@ -64,10 +64,9 @@ func (m windowsManager) setDomains(basePath string, domains []string) error {
 	return setRegistryString(path, "SearchList", value)
 }
 
-func (m windowsManager) Up(config Config) error {
-	var ipsv4 []string
-	var ipsv6 []string
-
+// splitNameservers returns config's nameservers as strings, split by
+// address family.
+func splitNameservers(config Config) (ipsv4, ipsv6 []string) {
 	for _, ip := range config.Nameservers {
 		if ip.Is4() {
 			ipsv4 = append(ipsv4, ip.String())
@@ -75,6 +74,11 @@ func (m windowsManager) Up(config Config) error {
 			ipsv6 = append(ipsv6, ip.String())
 		}
 	}
+	return ipsv4, ipsv6
+}
+
+func (m windowsManager) Up(config Config) error {
+	ipsv4, ipsv6 := splitNameservers(config)
 
 	if err := m.setNameservers(ipv4RegBase, ipsv4); err != nil {
 		return err
@@ -113,6 +117,39 @@ func (m windowsManager) Up(config Config) error {
 	return nil
 }
 
+// Verify checks the interface's nameservers and search domains in the
+// registry against config.
+func (m windowsManager) Verify(config Config) error {
+	ipsv4, ipsv6 := splitNameservers(config)
+	if err := m.verifyValues(ipv4RegBase, ipsv4, config.Domains); err != nil {
+		return err
+	}
+	return m.verifyValues(ipv6RegBase, ipsv6, config.Domains)
+}
+
+func (m windowsManager) verifyValues(basePath string, nameservers, domains []string) error {
+	path := fmt.Sprintf(`%s\Interfaces\%s`, basePath, m.guid)
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer key.Close()
+
+	for _, v := range []struct{ name, want string }{
+		{"NameServer", strings.Join(nameservers, ",")},
+		{"SearchList", strings.Join(domains, ",")},
+	} {
+		got, _, err := key.GetStringValue(v.name)
+		if err != nil && err != registry.ErrNotExist {
+			return fmt.Errorf("reading %s[%s]: %w", path, v.name, err)
+		}
+		if got != v.want {
+			return fmt.Errorf("%s[%s] is %q, want %q", path, v.name, got, v.want)
+		}
+	}
+	return nil
+}
+
 func (m windowsManager) Down() error {
 	return m.Up(Config{Nameservers: nil, Domains: nil})
 }
@@ -0,0 +1,14 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import "context"
+
+// WaitForRules blocks until the firewall goroutine of r, which must be
+// a Windows Router from New, is idle or ctx is done. It returns the
+// CIDRs last applied to the Tailscale-In rules.
+func WaitForRules(ctx context.Context, r Router) ([]string, error) {
+	return r.(*winRouter).firewall.waitIdle(ctx)
+}
@@ -0,0 +1,268 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	ole "github.com/go-ole/go-ole"
+	"github.com/go-ole/go-ole/oleutil"
+)
+
+// installedFirewallRule is a Windows Firewall rule as reported by the
+// firewall's COM API.
+type installedFirewallRule struct {
+	Name           string
+	Enabled        bool
+	LocalAddresses string
+	Application    string
+	Profiles       int32 // NET_FW_PROFILE_TYPE2 bitmask
+}
+
+// NET_FW_PROFILE_TYPE2 values.
+const (
+	fwProfileDomain  = 1
+	fwProfilePrivate = 2
+	fwProfilePublic  = 4
+)
+
+// fwProfileForCategory maps an NLM_NETWORK_CATEGORY to the firewall
+// profile Windows applies to networks in it.
+var fwProfileForCategory = map[int32]int32{
+	categoryPublic:  fwProfilePublic,
+	categoryPrivate: fwProfilePrivate,
+	categoryDomain:  fwProfileDomain,
+}
+
+// queryFirewallRules returns the installed firewall rules with any of
+// the given names.
+//
+// It uses the HNetCfg.FwPolicy2 COM object rather than "netsh
+// advfirewall firewall show", whose output is localized.
+func queryFirewallRules(names ...string) ([]installedFirewallRule, error) {
+	want := map[string]bool{}
+	for _, n := range names {
+		want[n] = true
+	}
+
+	// As in setPrivateNetwork, OLE wants the OS thread locked.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var c ole.Connection
+	if err := c.Initialize(); err != nil {
+		return nil, fmt.Errorf("c.Initialize: %v", err)
+	}
+	defer c.Uninitialize()
+
+	unk, err := oleutil.CreateObject("HNetCfg.FwPolicy2")
+	if err != nil {
+		return nil, fmt.Errorf("CreateObject(HNetCfg.FwPolicy2): %v", err)
+	}
+	defer unk.Release()
+	policy, err := unk.QueryInterface(ole.IID_IDispatch)
+	if err != nil {
+		return nil, fmt.Errorf("QueryInterface: %v", err)
+	}
+	defer policy.Release()
+
+	rulesV, err := oleutil.GetProperty(policy, "Rules")
+	if err != nil {
+		return nil, fmt.Errorf("get Rules: %v", err)
+	}
+	defer rulesV.Clear()
+
+	var ret []installedFirewallRule
+	err = oleutil.ForEach(rulesV.ToIDispatch(), func(v *ole.VARIANT) error {
+		defer v.Clear()
+		rule := v.ToIDispatch()
+		name, err := stringProperty(rule, "Name")
+		if err != nil || !want[name] {
+			return err
+		}
+		r := installedFirewallRule{Name: name}
+		if r.LocalAddresses, err = stringProperty(rule, "LocalAddresses"); err != nil {
+			return err
+		}
+		if r.Application, err = stringProperty(rule, "ApplicationName"); err != nil {
+			return err
+		}
+		enabled, err := oleutil.GetProperty(rule, "Enabled")
+		if err != nil {
+			return fmt.Errorf("get Enabled: %v", err)
+		}
+		r.Enabled, _ = enabled.Value().(bool)
+		enabled.Clear()
+		profiles, err := oleutil.GetProperty(rule, "Profiles")
+		if err != nil {
+			return fmt.Errorf("get Profiles: %v", err)
+		}
+		r.Profiles, _ = profiles.Value().(int32)
+		profiles.Clear()
+		ret = append(ret, r)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("enumerating rules: %v", err)
+	}
+	return ret, nil
+}
+
+func stringProperty(disp *ole.IDispatch, name string) (string, error) {
+	v, err := oleutil.GetProperty(disp, name)
+	if err != nil {
+		return "", fmt.Errorf("get %s: %v", name, err)
+	}
+	defer v.Clear()
+	return v.ToString(), nil
+}
+
+// FirewallDebug returns a human-readable report comparing the firewall
+// rules the router wants with the ones Windows reports as installed,
+// for bug reports.
+func (r *winRouter) FirewallDebug() string {
+	var sb strings.Builder
+	r.firewall.writeState(&sb)
+	// There's no killswitch: the router only ever adds allow rules.
+	sb.WriteString("killswitch: not supported\n")
+
+	rules, err := r.queryFirewall("Tailscale-In", "Tailscale-Process")
+	if err != nil {
+		fmt.Fprintf(&sb, "installed rules: error: %v\n", err)
+		return sb.String()
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Name != rules[j].Name {
+			return rules[i].Name < rules[j].Name
+		}
+		return rules[i].LocalAddresses < rules[j].LocalAddresses
+	})
+	fmt.Fprintf(&sb, "installed rules: %d\n", len(rules))
+	for _, rule := range rules {
+		fmt.Fprintf(&sb, "  %s enabled=%v", rule.Name, rule.Enabled)
+		if rule.LocalAddresses != "" {
+			fmt.Fprintf(&sb, " localip=%s", rule.LocalAddresses)
+		}
+		if rule.Application != "" {
+			fmt.Fprintf(&sb, " program=%s", rule.Application)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// FirewallLastApplied returns when the router last finished applying
+// its firewall rules successfully, or the zero time if it never has.
+// A time older than the last change of routes means the rules on the
+// system may not match what the router wants.
+func (r *winRouter) FirewallLastApplied() time.Time {
+	r.firewall.mu.Lock()
+	defer r.firewall.mu.Unlock()
+	return r.firewall.lastAppliedOK
+}
+
+// firewallLeakHealth returns an error if more Tailscale-In rules are
+// installed than the firewallTweaker has applied, which means a bug is
+// adding rules without deleting the old ones. It's quiet while the
+// firewallTweaker is still applying changes or the rules can't be
+// queried.
+func (r *winRouter) firewallLeakHealth() error {
+	ft := r.firewall
+	ft.mu.Lock()
+	settled := ft.known && !ft.running
+	want := len(ft.lastVal)
+	ft.mu.Unlock()
+	if !settled {
+		return nil
+	}
+
+	rules, err := r.queryFirewall("Tailscale-In")
+	if err != nil {
+		r.logf("firewall leak check: %v", err)
+		return nil
+	}
+	if len(rules) > want {
+		return fmt.Errorf("found %d Tailscale-In firewall rules; expected %d", len(rules), want)
+	}
+	return nil
+}
+
+// firewallProfileHealth returns an error if the Tailscale-In rules
+// aren't effective in the firewall profile Windows applies to the TUN
+// interface's network, which happens when something moves it out of
+// the private category the router puts it in. Windows Firewall then
+// drops inbound Tailscale traffic despite the rules. Like
+// firewallLeakHealth, it's quiet while rules are being applied or
+// can't be queried.
+func (r *winRouter) firewallProfileHealth() error {
+	ft := r.firewall
+	ft.mu.Lock()
+	settled := ft.known && !ft.running
+	ft.mu.Unlock()
+	if !settled {
+		return nil
+	}
+
+	cat, err := r.ifc.NetworkCategory()
+	if err != nil {
+		r.logf("firewall profile check: %v", err)
+		return nil
+	}
+	want, ok := fwProfileForCategory[cat]
+	if !ok {
+		return nil
+	}
+	rules, err := r.queryFirewall("Tailscale-In")
+	if err != nil {
+		r.logf("firewall profile check: %v", err)
+		return nil
+	}
+	var missing []string
+	for _, rule := range rules {
+		if rule.Enabled && rule.Profiles&want == 0 {
+			missing = append(missing, rule.LocalAddresses)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("Tailscale-In firewall rules for %s don't apply to the Tailscale adapter's %s network profile; inbound Tailscale traffic may be blocked",
+		strings.Join(missing, ", "), fwProfileName(want))
+}
+
+func fwProfileName(p int32) string {
+	switch p {
+	case fwProfileDomain:
+		return "domain"
+	case fwProfilePrivate:
+		return "private"
+	case fwProfilePublic:
+		return "public"
+	}
+	return fmt.Sprintf("%#x", p)
+}
+
+// writeState writes the firewallTweaker's view of the rules it has
+// installed and wants to install to sb.
+func (ft *firewallTweaker) writeState(sb *strings.Builder) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	fmt.Fprintf(sb, "desired Tailscale-In: %q\n", ft.want)
+	if ft.known {
+		fmt.Fprintf(sb, "applied Tailscale-In: %q\n", ft.lastVal)
+	} else {
+		sb.WriteString("applied Tailscale-In: unknown\n")
+	}
+	fmt.Fprintf(sb, "Tailscale-Process added: %v", ft.didProcRule)
+	if !ft.procRuleRetry.IsZero() {
+		fmt.Fprintf(sb, " (retrying in %v)", time.Until(ft.procRuleRetry).Round(time.Second))
+	}
+	sb.WriteString("\n")
+}
@@ -19,7 +19,9 @@ import (
 	ole "github.com/go-ole/go-ole"
 	"github.com/tailscale/wireguard-go/tun"
 	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"tailscale.com/health"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/wgengine/winnet"
 )
@@ -41,11 +43,24 @@ import (
 func monitorDefaultRoutes(tun *tun.NativeTun) (*winipcfg.RouteChangeCallback, error) {
 	ourLuid := winipcfg.LUID(tun.LUID())
 	lastMtu := uint32(0)
+	haveDefault := true
 	doIt := func() error {
-		mtu, err := getDefaultRouteMTU()
+		mtu, ok, err := getDefaultRouteMTU()
 		if err != nil {
 			return fmt.Errorf("error getting default route MTU: %w", err)
 		}
+		if ok != haveDefault {
+			haveDefault = ok
+			if ok {
+				log.Printf("monitorDefaultRoutes: default route is back")
+				health.SetDefaultRouteHealth(nil)
+			} else {
+				// Nothing we can do about it from here, but
+				// make it stand out in logs and health.
+				log.Printf("monitorDefaultRoutes: WARNING: no default route on any non-Tailscale interface; the machine is offline")
+				health.SetDefaultRouteHealth(errors.New("no default route outside Tailscale; the machine has no internet access"))
+			}
+		}
 
 		if mtu > 0 && (lastMtu == 0 || lastMtu != mtu) {
 			iface, err := ourLuid.IPInterface(windows.AF_INET)
@@ -103,19 +118,32 @@ func monitorDefaultRoutes(tun *tun.NativeTun) (*winipcfg.RouteChangeCallback, er
 	return cb, nil
 }
 
-func getDefaultRouteMTU() (uint32, error) {
+// getDefaultRouteMTU returns the MTU of the OS's default route, and
+// whether there is a default route outside Tailscale at all.
+func getDefaultRouteMTU() (mtu uint32, ok bool, err error) {
 	mtus, err := interfaces.NonTailscaleMTUs()
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
-
-	routes, err := winipcfg.GetIPForwardTable2(windows.AF_INET)
+	routes4, err := winipcfg.GetIPForwardTable2(windows.AF_INET)
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
+	routes6, err := winipcfg.GetIPForwardTable2(windows.AF_INET6)
+	if err != nil {
+		return 0, false, err
+	}
+	mtu, ok = defaultRouteMTU(mtus, routes4, routes6)
+	return mtu, ok, nil
+}
+
+// defaultRouteMTU returns the MTU to use given the IPv4 and IPv6
+// routing tables and the MTUs of the non-Tailscale interfaces: that of
+// the best IPv4 default route, lowered to that of the best IPv6 one.
+// ok reports whether any default route uses a non-Tailscale interface.
+func defaultRouteMTU(mtus map[winipcfg.LUID]uint32, routes4, routes6 []winipcfg.MibIPforwardRow2) (mtu uint32, ok bool) {
 	best := ^uint32(0)
-	mtu := uint32(0)
-	for _, route := range routes {
+	for _, route := range routes4 {
 		if route.DestinationPrefix.PrefixLength != 0 {
 			continue
 		}
@@ -123,18 +151,15 @@ func getDefaultRouteMTU() (uint32, error) {
 		if routeMTU == 0 {
 			continue
 		}
+		ok = true
 		if route.Metric < best {
 			best = route.Metric
 			mtu = routeMTU
 		}
 	}
 
-	routes, err = winipcfg.GetIPForwardTable2(windows.AF_INET6)
-	if err != nil {
-		return 0, err
-	}
 	best = ^uint32(0)
-	for _, route := range routes {
+	for _, route := range routes6 {
 		if route.DestinationPrefix.PrefixLength != 0 {
 			continue
 		}
@@ -142,6 +167,7 @@ func getDefaultRouteMTU() (uint32, error) {
 		if routeMTU == 0 {
 			continue
 		}
+		ok = true
 		if route.Metric < best {
 			best = route.Metric
 			if routeMTU < mtu {
@@ -150,19 +176,50 @@ func getDefaultRouteMTU() (uint32, error) {
 		}
 	}
 
-	return mtu, nil
+	return mtu, ok
 }
 
+// NLM_NETWORK_CATEGORY values.
+const (
+	categoryPublic  = 0
+	categoryPrivate = 1
+	categoryDomain  = 2
+)
+
 // setPrivateNetwork marks the provided network adapter's category to private.
 // It returns (false, nil) if the adapter was not found.
 func setPrivateNetwork(ifcLUID winipcfg.LUID) (bool, error) {
-	// NLM_NETWORK_CATEGORY values.
-	const (
-		categoryPublic  = 0
-		categoryPrivate = 1
-		categoryDomain  = 2
-	)
+	return withAdapterNetwork(ifcLUID, func(n *winnet.INetwork) error {
+		cat, err := n.GetCategory()
+		if err != nil {
+			return fmt.Errorf("GetCategory: %v", err)
+		}
+		if cat != categoryPrivate {
+			if err := n.SetCategory(categoryPrivate); err != nil {
+				return fmt.Errorf("SetCategory: %v", err)
+			}
+		}
+		return nil
+	})
+}
 
+// networkCategory returns the NLM_NETWORK_CATEGORY of the provided
+// network adapter. It returns ok=false if the adapter was not found.
+func networkCategory(ifcLUID winipcfg.LUID) (cat int32, ok bool, err error) {
+	ok, err = withAdapterNetwork(ifcLUID, func(n *winnet.INetwork) error {
+		cat, err = n.GetCategory()
+		if err != nil {
+			return fmt.Errorf("GetCategory: %v", err)
+		}
+		return nil
+	})
+	return cat, ok, err
+}
+
+// withAdapterNetwork calls fn with the network list manager's network
+// for the provided network adapter. It returns (false, nil) if the
+// adapter was not found.
+func withAdapterNetwork(ifcLUID winipcfg.LUID, fn func(*winnet.INetwork) error) (bool, error) {
 	ifcGUID, err := ifcLUID.GUID()
 	if err != nil {
 		return false, fmt.Errorf("ifcLUID.GUID: %v", err)
@@ -207,15 +264,8 @@ func setPrivateNetwork(ifcLUID winipcfg.LUID) (bool, error) {
 		}
 		defer n.Release()
 
-		cat, err := n.GetCategory()
-		if err != nil {
-			return false, fmt.Errorf("GetCategory: %v", err)
-		}
-
-		if cat != categoryPrivate {
-			if err := n.SetCategory(categoryPrivate); err != nil {
-				return false, fmt.Errorf("SetCategory: %v", err)
-			}
+		if err := fn(n); err != nil {
+			return false, err
 		}
 		return true, nil
 	}
@@ -426,6 +476,82 @@ func configureInterface(cfg *Config, tun *tun.NativeTun) (retErr error) {
 	return errAcc
 }
 
+// dnsRegistrationKeys are the registry keys holding each interface's
+// RegistrationEnabled value, in a subkey named by its GUID. The IPv6
+// key is missing with IPv6 disabled.
+var dnsRegistrationKeys = []struct {
+	base     string
+	optional bool // whether the key can be missing
+}{
+	{`SYSTEM\CurrentControlSet\Services\Tcpip\Parameters`, false},
+	{`SYSTEM\CurrentControlSet\Services\Tcpip6\Parameters`, true},
+}
+
+// disableDNSRegistration stops Windows from registering the addresses
+// of the interface with the given LUID in DNS, like unchecking the
+// "Register this connection's addresses in DNS" box in its TCP/IP
+// settings. It returns a func that puts back the RegistrationEnabled
+// values it replaced, or removes the ones it added, so that an
+// administrator's or group policy's choice survives.
+func disableDNSRegistration(luid winipcfg.LUID) (restore func() error, err error) {
+	guid, err := luid.GUID()
+	if err != nil {
+		return nil, err
+	}
+	type savedValue struct {
+		path string
+		v    uint32
+		ok   bool // whether there was a value
+	}
+	var saved []savedValue
+	restore = func() error {
+		var errs []error
+		for _, s := range saved {
+			key, err := registry.OpenKey(registry.LOCAL_MACHINE, s.path, registry.SET_VALUE)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("opening %s: %w", s.path, err))
+				continue
+			}
+			if s.ok {
+				err = key.SetDWordValue("RegistrationEnabled", s.v)
+			} else {
+				err = key.DeleteValue("RegistrationEnabled")
+			}
+			key.Close()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("restoring %s[RegistrationEnabled]: %w", s.path, err))
+			}
+		}
+		return multierror.New(errs)
+	}
+	for _, k := range dnsRegistrationKeys {
+		path := fmt.Sprintf(`%s\Interfaces\%s`, k.base, guid)
+		key, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE|registry.SET_VALUE)
+		if k.optional && errors.Is(err, registry.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			restore()
+			return nil, fmt.Errorf("opening %s: %w", path, err)
+		}
+		v, _, err := key.GetIntegerValue("RegistrationEnabled")
+		if err != nil && !errors.Is(err, registry.ErrNotExist) {
+			key.Close()
+			restore()
+			return nil, fmt.Errorf("reading %s[RegistrationEnabled]: %w", path, err)
+		}
+		s := savedValue{path: path, v: uint32(v), ok: err == nil}
+		err = key.SetDWordValue("RegistrationEnabled", 0)
+		key.Close()
+		if err != nil {
+			restore()
+			return nil, fmt.Errorf("setting %s[RegistrationEnabled]: %w", path, err)
+		}
+		saved = append(saved, s)
+	}
+	return restore, nil
+}
+
 // routeLess reports whether ri should sort before rj.
 // The actual sort order doesn't appear to matter. The caller just
 // wants them sorted to be able to de-dup.
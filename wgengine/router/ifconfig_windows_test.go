@@ -238,3 +238,65 @@ func TestDeltaRouteData(t *testing.T) {
 		t.Errorf("del:\n   got: %v\n  want: %v\n", del, wantDel)
 	}
 }
+
+func TestDefaultRouteMTU(t *testing.T) {
+	const (
+		ethernet winipcfg.LUID = 1
+		wifi     winipcfg.LUID = 2
+		ts       winipcfg.LUID = 3 // not in mtus
+	)
+	mtus := map[winipcfg.LUID]uint32{ethernet: 1500, wifi: 1400}
+	route := func(luid winipcfg.LUID, bits uint8, metric uint32) winipcfg.MibIPforwardRow2 {
+		var r winipcfg.MibIPforwardRow2
+		r.InterfaceLUID = luid
+		r.DestinationPrefix.PrefixLength = bits
+		r.Metric = metric
+		return r
+	}
+	type R = []winipcfg.MibIPforwardRow2
+
+	tests := []struct {
+		name             string
+		routes4, routes6 R
+		wantMTU          uint32
+		wantOK           bool
+	}{
+		{name: "empty"},
+		{
+			name:    "no_default",
+			routes4: R{route(ethernet, 24, 1)},
+			routes6: R{route(wifi, 64, 1)},
+		},
+		{
+			name:    "only_tailscale_default",
+			routes4: R{route(ts, 0, 1), route(ethernet, 24, 1)},
+		},
+		{
+			name:    "v4_default",
+			routes4: R{route(ts, 0, 1), route(ethernet, 0, 10), route(wifi, 0, 5)},
+			wantMTU: 1400,
+			wantOK:  true,
+		},
+		{
+			name:    "v6_lowers",
+			routes4: R{route(ethernet, 0, 1)},
+			routes6: R{route(wifi, 0, 1)},
+			wantMTU: 1400,
+			wantOK:  true,
+		},
+		{
+			name:    "v6_only",
+			routes6: R{route(ethernet, 0, 1)},
+			wantMTU: 0,
+			wantOK:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mtu, ok := defaultRouteMTU(mtus, tt.routes4, tt.routes6)
+			if mtu != tt.wantMTU || ok != tt.wantOK {
+				t.Errorf("defaultRouteMTU = %v, %v; want %v, %v", mtu, ok, tt.wantMTU, tt.wantOK)
+			}
+		})
+	}
+}
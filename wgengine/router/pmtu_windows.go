@@ -0,0 +1,96 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+// pmtuProbeHostEnv, if set to an IPv4 address, makes the router
+// periodically check that packets as big as the default route's MTU
+// reach it. There's no probe target by default: the router doesn't know
+// of a host that's sure to answer.
+const pmtuProbeHostEnv = "TS_DEBUG_PMTU_PROBE_HOST"
+
+const (
+	// pmtuMinSize is the smallest packet size probed, which any IPv4
+	// path must carry.
+	pmtuMinSize = 576
+	// pmtuPrecision is how close, in bytes, the search for the
+	// largest working packet size gets.
+	pmtuPrecision = 8
+)
+
+// pmtuProbeTarget returns the winRouter.pmtuTarget requested by the
+// environment, or the zero IP for none.
+func pmtuProbeTarget(logf logger.Logf) netaddr.IP {
+	v := os.Getenv(pmtuProbeHostEnv)
+	if v == "" {
+		return netaddr.IP{}
+	}
+	ip, err := netaddr.ParseIP(v)
+	if err != nil || !ip.Is4() {
+		logf("ignoring %s=%q: not an IPv4 address", pmtuProbeHostEnv, v)
+		return netaddr.IP{}
+	}
+	return ip
+}
+
+// pmtuHealth returns an error if small packets reach r.pmtuTarget but
+// ones the size of the default route's MTU don't. That's a path MTU
+// black hole: a link along the way can't carry full-size packets and
+// drops them without the ICMP message that path MTU discovery relies
+// on, so big transfers stall.
+//
+// The error gives the largest size that got through. Lowering the
+// default interface's MTU to it fixes the Tailscale interface too, as
+// monitorDefaultRoutes keeps that in step.
+func (r *winRouter) pmtuHealth() error {
+	if r.pmtuTarget.IsZero() {
+		return nil
+	}
+	mtu, err := r.ifc.DefaultRouteMTU()
+	if err != nil || mtu <= pmtuMinSize {
+		return nil
+	}
+	if r.probePMTU(r.pmtuTarget, int(mtu)) == nil {
+		return nil
+	}
+	if r.probePMTU(r.pmtuTarget, pmtuMinSize) != nil {
+		// Nothing gets through; that's not an MTU problem.
+		return nil
+	}
+	lo, hi := pmtuMinSize, int(mtu) // lo gets through, hi doesn't
+	for hi-lo > pmtuPrecision {
+		mid := (lo + hi) / 2
+		if r.probePMTU(r.pmtuTarget, mid) == nil {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return fmt.Errorf("packets over %d bytes don't reach %v though the default route's MTU is %d; lower the default interface's MTU to %d",
+		lo, r.pmtuTarget, mtu, lo)
+}
+
+// pingDF pings ip once with an IPv4 packet of size bytes that mustn't
+// be fragmented, returning an error if no reply came back.
+//
+// ping's exit status doesn't say whether the packet was lost or
+// refused with an ICMP error, and its output is localized, so a path
+// that just has a smaller MTU also looks like a failure here.
+func pingDF(ip netaddr.IP, size int) error {
+	payload := size - 28 // IPv4 and ICMP headers
+	cmd := exec.Command("ping", "-n", "1", "-w", "2000", "-f", "-l", strconv.Itoa(payload), ip.String())
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	return cmd.Run()
+}
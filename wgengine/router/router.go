@@ -7,9 +7,13 @@
 package router
 
 import (
+	"crypto/sha256"
+	"sort"
+
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
 	"inet.af/netaddr"
+	"tailscale.com/internal/deepprint"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/preftype"
 	"tailscale.com/wgengine/router/dns"
@@ -31,6 +35,84 @@ type Router interface {
 	Close() error
 }
 
+// RouterCapabilities describes which optional features a Router
+// supports, so callers can avoid offering ones that it doesn't.
+type RouterCapabilities struct {
+	// Killswitch is whether the router can block traffic that
+	// bypasses the tunnel.
+	Killswitch bool
+	// IPv6 is whether the router configures IPv6 addresses and
+	// routes on the interface.
+	IPv6 bool
+	// PerAppExclusion is whether the router can exclude individual
+	// applications from the tunnel.
+	PerAppExclusion bool
+}
+
+// capabilitiesReporter is implemented by Routers that can report their
+// RouterCapabilities.
+type capabilitiesReporter interface {
+	Capabilities() RouterCapabilities
+}
+
+// Capabilities returns the optional features supported by r. Routers
+// that don't report their capabilities are assumed to support none.
+func Capabilities(r Router) RouterCapabilities {
+	if cr, ok := r.(capabilitiesReporter); ok {
+		return cr.Capabilities()
+	}
+	return RouterCapabilities{}
+}
+
+// RouterMetrics are cumulative counters of a Router's work since it
+// was created, for spotting routers that reconfigure too often.
+type RouterMetrics struct {
+	// Sets is the number of Set calls, and SetFailures how many of
+	// them returned an error.
+	Sets, SetFailures int64
+	// RoutesAdded and RoutesRemoved count routes added to and
+	// removed from the interface, and AddrsAdded and AddrsRemoved
+	// its addresses.
+	RoutesAdded, RoutesRemoved int64
+	AddrsAdded, AddrsRemoved   int64
+	// InterfaceFailures is the number of failures to program the
+	// interface's addresses and routes, which are applied together.
+	InterfaceFailures int64
+	// DNSApplies is the number of times the OS DNS config was
+	// applied, and DNSFailures how many of those failed.
+	DNSApplies, DNSFailures int64
+	// FirewallApplies is the number of attempts to apply firewall
+	// rules, and FirewallFailures how many of those failed.
+	FirewallApplies, FirewallFailures int64
+}
+
+// metricsReporter is implemented by Routers that keep RouterMetrics.
+type metricsReporter interface {
+	Metrics() RouterMetrics
+}
+
+// Metrics returns r's counters, or zero ones if r doesn't keep any.
+func Metrics(r Router) RouterMetrics {
+	if mr, ok := r.(metricsReporter); ok {
+		return mr.Metrics()
+	}
+	return RouterMetrics{}
+}
+
+// listenPortSetter is implemented by Routers whose firewall rules can
+// be scoped to the UDP ports the engine listens on.
+type listenPortSetter interface {
+	SetListenPorts(ports []uint16)
+}
+
+// SetListenPorts tells r which UDP ports the engine listens on, for
+// routers that scope firewall rules to them. It's a no-op for others.
+func SetListenPorts(r Router, ports ...uint16) {
+	if ps, ok := r.(listenPortSetter); ok {
+		ps.SetListenPorts(ports)
+	}
+}
+
 // New returns a new Router for the current platform, using the
 // provided tun device.
 func New(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error) {
@@ -62,6 +144,22 @@ type Config struct {
 
 	DNS dns.Config
 
+	// Windows-only things below, ignored on other platforms.
+
+	// SearchDomains are additional DNS search domains to use,
+	// after those in DNS.Domains.
+	SearchDomains []string
+	// DisableDNSRegistration is whether to stop Windows from
+	// registering the Tailscale interface's addresses in DNS. When
+	// it goes back to false, or the router closes, the interface's
+	// previous setting is restored; otherwise it's left alone.
+	DisableDNSRegistration bool
+	// BlackholeWithdrawnRoutes is whether routes removed from Routes
+	// keep pointing into the Tailscale interface for a short grace
+	// period, where traffic to them is dropped, rather than falling
+	// back to the physical default route at once.
+	BlackholeWithdrawnRoutes bool
+
 	// Linux-only things below, ignored on other platforms.
 
 	SubnetRoutes     []netaddr.IPPrefix     // subnets being advertised to other Tailscale nodes
@@ -69,6 +167,44 @@ type Config struct {
 	NetfilterMode    preftype.NetfilterMode // how much to manage netfilter rules
 }
 
+// clone returns a deep copy of c.
+func (c *Config) clone() *Config {
+	ret := *c
+	ret.LocalAddrs = append([]netaddr.IPPrefix(nil), c.LocalAddrs...)
+	ret.Routes = append([]netaddr.IPPrefix(nil), c.Routes...)
+	ret.SubnetRoutes = append([]netaddr.IPPrefix(nil), c.SubnetRoutes...)
+	ret.DNS.Nameservers = append([]netaddr.IP(nil), c.DNS.Nameservers...)
+	ret.DNS.Domains = append([]string(nil), c.DNS.Domains...)
+	ret.SearchDomains = append([]string(nil), c.SearchDomains...)
+	return &ret
+}
+
+// Hash returns a hash of c, for telling whether two Configs would
+// program the OS differently. LocalAddrs, Routes and SubnetRoutes are
+// hashed regardless of order, as they're sets to the OS. DNS
+// nameservers and search domains aren't: their order is significant.
+// A nil or empty slice hashes the same as any other empty slice.
+func (c *Config) Hash() [32]byte {
+	cc := c.clone()
+	sortPrefixes(cc.LocalAddrs)
+	sortPrefixes(cc.Routes)
+	sortPrefixes(cc.SubnetRoutes)
+	h := sha256.New()
+	deepprint.Print(h, cc)
+	var ret [32]byte
+	h.Sum(ret[:0])
+	return ret
+}
+
+func sortPrefixes(ps []netaddr.IPPrefix) {
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].IP != ps[j].IP {
+			return ps[i].IP.Less(ps[j].IP)
+		}
+		return ps[i].Bits < ps[j].Bits
+	})
+}
+
 // shutdownConfig is a routing configuration that removes all router
 // state from the OS. It's the config used when callers pass in a nil
 // Config.
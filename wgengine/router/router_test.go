@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/wgengine/router/dns"
+)
+
+func TestConfigHash(t *testing.T) {
+	pfx := netaddr.MustParseIPPrefix
+	base := func() *Config {
+		return &Config{
+			LocalAddrs: []netaddr.IPPrefix{pfx("100.101.102.103/32"), pfx("fd7a:115c:a1e0::1/128")},
+			Routes:     []netaddr.IPPrefix{pfx("100.64.0.0/10"), pfx("10.0.0.0/8")},
+			DNS: dns.Config{
+				Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100"), netaddr.MustParseIP("8.8.8.8")},
+				Domains:     []string{"foo.example", "bar.example"},
+			},
+			SearchDomains: []string{"corp.example"},
+		}
+	}
+	want := base().Hash()
+
+	same := []struct {
+		name string
+		mod  func(*Config)
+	}{
+		{"identical", func(*Config) {}},
+		{"LocalAddrs reordered", func(c *Config) {
+			c.LocalAddrs[0], c.LocalAddrs[1] = c.LocalAddrs[1], c.LocalAddrs[0]
+		}},
+		{"Routes reordered", func(c *Config) {
+			c.Routes[0], c.Routes[1] = c.Routes[1], c.Routes[0]
+		}},
+		{"empty vs nil SubnetRoutes", func(c *Config) { c.SubnetRoutes = []netaddr.IPPrefix{} }},
+	}
+	for _, tt := range same {
+		c := base()
+		tt.mod(c)
+		if got := c.Hash(); got != want {
+			t.Errorf("%s: hash changed", tt.name)
+		}
+	}
+
+	differ := []struct {
+		name string
+		mod  func(*Config)
+	}{
+		{"LocalAddrs", func(c *Config) { c.LocalAddrs[0] = pfx("100.101.102.104/32") }},
+		{"Routes", func(c *Config) { c.Routes = c.Routes[:1] }},
+		{"route bits", func(c *Config) { c.Routes[1] = pfx("10.0.0.0/16") }},
+		{"Nameservers reordered", func(c *Config) {
+			ns := c.DNS.Nameservers
+			ns[0], ns[1] = ns[1], ns[0]
+		}},
+		{"Domains reordered", func(c *Config) {
+			d := c.DNS.Domains
+			d[0], d[1] = d[1], d[0]
+		}},
+		{"DNS.Proxied", func(c *Config) { c.DNS.Proxied = true }},
+		{"SearchDomains", func(c *Config) { c.SearchDomains = nil }},
+		{"SearchDomains appended", func(c *Config) { c.SearchDomains = append(c.SearchDomains, "more.example") }},
+		{"DisableDNSRegistration", func(c *Config) { c.DisableDNSRegistration = true }},
+		{"BlackholeWithdrawnRoutes", func(c *Config) { c.BlackholeWithdrawnRoutes = true }},
+		{"SubnetRoutes", func(c *Config) { c.SubnetRoutes = []netaddr.IPPrefix{pfx("192.168.1.0/24")} }},
+		{"SNATSubnetRoutes", func(c *Config) { c.SNATSubnetRoutes = true }},
+		{"NetfilterMode", func(c *Config) { c.NetfilterMode++ }},
+	}
+	for _, tt := range differ {
+		c := base()
+		tt.mod(c)
+		if got := c.Hash(); got == want {
+			t.Errorf("%s: changing it didn't change the hash", tt.name)
+		}
+	}
+
+	// Every field must have a case above, so that one Hash skips
+	// can't go unnoticed.
+	typ := reflect.TypeOf(Config{})
+fields:
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Name
+		for _, tt := range differ {
+			if strings.HasPrefix(tt.name, name) {
+				continue fields
+			}
+		}
+		t.Errorf("no hash test case for Config.%s", name)
+	}
+}
@@ -6,29 +6,329 @@ package router
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net"
 	"os"
 	"os/exec"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/go-multierror/multierror"
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"inet.af/netaddr"
+	"tailscale.com/health"
 	"tailscale.com/logtail/backoff"
+	"tailscale.com/net/interfaces"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine/router/dns"
 )
 
 type winRouter struct {
-	logf                func(fmt string, args ...interface{})
-	tunname             string
-	nativeTun           *tun.NativeTun
-	wgdev               *device.Device
+	// metrics is first so that its int64s are 64-bit aligned for
+	// atomic access on 32-bit platforms.
+	metrics routerCounters
+
+	logf     func(fmt string, args ...interface{})
+	tunname  string
+	tunGUID  string
+	wgdev    *device.Device
+	dns      dnsManager
+	firewall *firewallTweaker
+
+	ctx    context.Context // canceled by Close
+	cancel context.CancelFunc
+	// bg tracks the goroutines started by Up, the route monitor
+	// retry and reconcileDNS, for Close to wait for.
+	bg sync.WaitGroup
+
+	// ifc configures the Tailscale interface. It's a
+	// winipcfgConfigurator, except in tests.
+	ifc ifaceConfigurator
+	// probeDNS is probeDNSServer, except in tests.
+	probeDNS func(server netaddr.IP, name string) error
+	// queryFirewall is queryFirewallRules, except in tests.
+	queryFirewall func(names ...string) ([]installedFirewallRule, error)
+	// pmtuTarget is the host pmtuHealth probes, or the zero IP to
+	// skip the check.
+	pmtuTarget netaddr.IP
+	// probePMTU is pingDF, except in tests.
+	probePMTU func(ip netaddr.IP, size int) error
+
+	// lastNonDNSHash is the Hash of the last Config whose interface
+	// configuration was applied successfully, ignoring its DNS
+	// fields. Zero if none is known to be applied.
+	lastNonDNSHash [32]byte
+
+	// dnsMu guards the DNS fields below and serializes calls to
+	// dns, which dnsOverriddenHealth makes from the health
+	// checker's goroutine.
+	dnsMu sync.Mutex
+	// lastDNS is the last DNS config successfully applied, if
+	// lastDNSOK is true.
+	lastDNS   dns.Config
+	lastDNSOK bool
+	// dnsTimeout is how long a dns.Set or dns.Down can take before
+	// setDNS gives up on it. If zero, defaultDNSTimeout is used.
+	dnsTimeout time.Duration
+	// dnsStuck, if non-nil, is closed when a DNS manager call that
+	// timed out finally returns. Until then the manager mustn't be
+	// called again.
+	dnsStuck chan struct{}
+	// dnsDrift is sent to, without blocking, by dnsOverriddenHealth
+	// when the OS DNS config no longer matches lastDNS, for
+	// reconcileDNS to reapply it.
+	dnsDrift chan struct{}
+	// dnsReapplyErr is why reconcileDNS last failed to reapply
+	// lastDNS, or nil. It's cleared by the next successful apply.
+	dnsReapplyErr error
+	// resetDNS is whether the next setDNS must take DNS down before
+	// applying: the last dns.Set failed, possibly leaving part of
+	// its config applied, or ReapplyAll was called, or something
+	// else changed the OS config.
+	resetDNS bool
+
+	mu                  sync.Mutex
+	lastCfg             *Config // clone of the last Config applied to the interface, or nil
 	routeChangeCallback *winipcfg.RouteChangeCallback
-	dns                 *dns.Manager
-	firewall            *firewallTweaker
+	unregisterChecks    []func()      // health checks registered by Up
+	onSet               func(*Config) // or nil; see OnSet
+	magicDNSServer      netaddr.IP    // MagicDNS resolver to probe, or zero if MagicDNS is off
+	magicDNSName        string        // name to query magicDNSServer for
+	dnsUpstreams        []netaddr.IP  // non-proxied DNS servers to probe
+	effectiveMTU        uint32        // interface MTU read back after the last Configure, or 0
+	// restoreDNSRegistration undoes Config.DisableDNSRegistration,
+	// or is nil if DNS registration was left alone.
+	restoreDNSRegistration func() error
+	// blackholes are the withdrawn routes still programmed because
+	// of Config.BlackholeWithdrawnRoutes, and when each expires.
+	blackholes map[netaddr.IPPrefix]time.Time
+
+	closeOnce sync.Once
+	closeErr  error // result of the first Close
+}
+
+// dnsManager is the subset of *dns.Manager used by winRouter.
+type dnsManager interface {
+	Set(dns.Config) error
+	Down() error
+	Verify() error
+}
+
+// ifaceConfigurator is the OS configuration of the Tailscale interface
+// used by winRouter.
+type ifaceConfigurator interface {
+	// Configure applies the non-DNS parts of cfg to the interface.
+	Configure(cfg *Config) error
+	// MonitorRoutes starts monitoring default route changes, to
+	// follow the MTU of the default route.
+	MonitorRoutes() (*winipcfg.RouteChangeCallback, error)
+	// Exists returns an error if the interface no longer exists.
+	Exists() error
+	// Routes returns the routes installed on the interface.
+	Routes() ([]netaddr.IPPrefix, error)
+	// DeleteRoute removes the interface's routes to p.
+	DeleteRoute(p netaddr.IPPrefix) error
+	// DefaultRouteMTU returns the MTU of the OS's default route, or
+	// zero if there's none.
+	DefaultRouteMTU() (uint32, error)
+	// OperUp reports whether the interface's operational status is
+	// up.
+	OperUp() (bool, error)
+	// IPv6Enabled reports whether IPv6 is enabled on the interface.
+	IPv6Enabled() (bool, error)
+	// Addrs returns the addresses bound to the interface and ready
+	// for use.
+	Addrs() ([]netaddr.IP, error)
+	// OtherSubnets returns the subnets the host's other interfaces
+	// are attached to.
+	OtherSubnets() ([]netaddr.IPPrefix, error)
+	// MTU returns the IPv4 MTU requested for the interface and the
+	// one the OS reports is in effect.
+	MTU() (requested, effective uint32, err error)
+	// NetworkCategory returns the NLM_NETWORK_CATEGORY Windows has
+	// assigned the interface's network, which selects the
+	// firewall profile that applies to it.
+	NetworkCategory() (int32, error)
+	// DisableDNSRegistration stops Windows from registering the
+	// interface's addresses in DNS. The returned func undoes it,
+	// restoring the previous setting.
+	DisableDNSRegistration() (restore func() error, err error)
+}
+
+// winipcfgConfigurator is the ifaceConfigurator for a wintun
+// interface, using winipcfg.
+type winipcfgConfigurator struct {
+	tun *tun.NativeTun
+}
+
+func (c winipcfgConfigurator) Configure(cfg *Config) error {
+	return configureInterface(cfg, c.tun)
+}
+
+func (c winipcfgConfigurator) MonitorRoutes() (*winipcfg.RouteChangeCallback, error) {
+	return monitorDefaultRoutes(c.tun)
+}
+
+// Exists checks that the interface's LUID still resolves.
+func (c winipcfgConfigurator) Exists() error {
+	luid := winipcfg.LUID(c.tun.LUID())
+	if _, err := luid.GUID(); err != nil {
+		return fmt.Errorf("TUN interface (LUID %#x) is missing: %v", uint64(luid), err)
+	}
+	return nil
+}
+
+func (c winipcfgConfigurator) DefaultRouteMTU() (uint32, error) {
+	mtu, _, err := getDefaultRouteMTU()
+	return mtu, err
+}
+
+func (c winipcfgConfigurator) OperUp() (bool, error) {
+	row, err := winipcfg.LUID(c.tun.LUID()).Interface()
+	if err != nil {
+		return false, err
+	}
+	return row.OperStatus == winipcfg.IfOperStatusUp, nil
+}
+
+// IPv6Enabled reports whether the interface has an IPv6 interface.
+// It doesn't when IPv6 is disabled for the whole host, such as with
+// the DisabledComponents registry value.
+func (c winipcfgConfigurator) IPv6Enabled() (bool, error) {
+	_, err := winipcfg.LUID(c.tun.LUID()).IPInterface(windows.AF_INET6)
+	if errors.Is(err, windows.ERROR_NOT_FOUND) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Addrs returns the interface's unicast addresses that have finished
+// duplicate address detection, so can be used.
+func (c winipcfgConfigurator) Addrs() ([]netaddr.IP, error) {
+	ifc, err := interfaceFromLUID(winipcfg.LUID(c.tun.LUID()), 0)
+	if err != nil {
+		return nil, err
+	}
+	var ret []netaddr.IP
+	for addr := ifc.FirstUnicastAddress; addr != nil; addr = addr.Next {
+		if addr.DadState != windows.IpDadStatePreferred {
+			continue
+		}
+		if ip, ok := netaddr.FromStdIP(addr.Address.IP()); ok {
+			ret = append(ret, ip)
+		}
+	}
+	return ret, nil
+}
+
+// OtherSubnets returns the on-link subnets of the host's up
+// interfaces other than Tailscale's, except loopback and link-local
+// ones.
+func (c winipcfgConfigurator) OtherSubnets() ([]netaddr.IPPrefix, error) {
+	ifs, err := interfaces.NonTailscaleInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ret []netaddr.IPPrefix
+	for _, ifc := range ifs {
+		if ifc.OperStatus != winipcfg.IfOperStatusUp {
+			continue
+		}
+		for addr := ifc.FirstUnicastAddress; addr != nil; addr = addr.Next {
+			ip, ok := netaddr.FromStdIP(addr.Address.IP())
+			if !ok || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			ret = append(ret, netaddr.IPPrefix{IP: ip, Bits: addr.OnLinkPrefixLength}.Masked())
+		}
+	}
+	return ret, nil
+}
+
+// MTU returns the MTU the TUN device was last forced to, and the
+// NLMTU that Windows reports for the interface, which it may have
+// clamped.
+func (c winipcfgConfigurator) MTU() (requested, effective uint32, err error) {
+	mtu, err := c.tun.MTU()
+	if err != nil {
+		return 0, 0, err
+	}
+	iface, err := winipcfg.LUID(c.tun.LUID()).IPInterface(windows.AF_INET)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(mtu), iface.NLMTU, nil
+}
+
+func (c winipcfgConfigurator) NetworkCategory() (int32, error) {
+	cat, ok, err := networkCategory(winipcfg.LUID(c.tun.LUID()))
+	if err == nil && !ok {
+		err = errors.New("TUN interface not found in network list")
+	}
+	return cat, err
+}
+
+func (c winipcfgConfigurator) DisableDNSRegistration() (restore func() error, err error) {
+	return disableDNSRegistration(winipcfg.LUID(c.tun.LUID()))
+}
+
+func (c winipcfgConfigurator) Routes() ([]netaddr.IPPrefix, error) {
+	luid := winipcfg.LUID(c.tun.LUID())
+	var ret []netaddr.IPPrefix
+	for _, family := range []winipcfg.AddressFamily{windows.AF_INET, windows.AF_INET6} {
+		rows, err := winipcfg.GetIPForwardTable2(family)
+		if err != nil {
+			return nil, err
+		}
+		for i := range rows {
+			row := &rows[i]
+			if row.InterfaceLUID != luid {
+				continue
+			}
+			ip, ok := netaddr.FromStdIP(row.DestinationPrefix.RawPrefix.IP())
+			if !ok {
+				continue
+			}
+			ret = append(ret, netaddr.IPPrefix{IP: ip, Bits: row.DestinationPrefix.PrefixLength})
+		}
+	}
+	return ret, nil
+}
+
+func (c winipcfgConfigurator) DeleteRoute(p netaddr.IPPrefix) error {
+	luid := winipcfg.LUID(c.tun.LUID())
+	family := winipcfg.AddressFamily(windows.AF_INET)
+	if p.IP.Is6() {
+		family = windows.AF_INET6
+	}
+	rows, err := winipcfg.GetIPForwardTable2(family)
+	if err != nil {
+		return err
+	}
+	for i := range rows {
+		row := &rows[i]
+		if row.InterfaceLUID != luid || row.DestinationPrefix.PrefixLength != p.Bits {
+			continue
+		}
+		if ip, ok := netaddr.FromStdIP(row.DestinationPrefix.RawPrefix.IP()); !ok || ip != p.IP {
+			continue
+		}
+		if err := row.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error) {
@@ -49,64 +349,1117 @@ func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Devic
 		InterfaceName: guid.String(),
 	}
 
+	health.SetInfo("router-backend", "netsh")
+	health.SetInfo("tun-name", tunname)
+	health.SetInfo("tun-guid", guid.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
 	return &winRouter{
-		logf:      logf,
-		wgdev:     wgdev,
-		tunname:   tunname,
-		nativeTun: nativeTun,
-		dns:       dns.NewManager(mconfig),
-		firewall:  &firewallTweaker{logf: logger.WithPrefix(logf, "firewall: ")},
+		logf:    logf,
+		wgdev:   wgdev,
+		tunname: tunname,
+		tunGUID: guid.String(),
+		dns:     dns.NewManager(mconfig),
+		firewall: &firewallTweaker{
+			logf:              logger.WithPrefix(logf, "firewall: "),
+			maxBackoff:        firewallMaxBackoff(logf),
+			restrictProcPorts: firewallRestrictProcPorts(logf),
+		},
+		ctx:           ctx,
+		cancel:        cancel,
+		ifc:           winipcfgConfigurator{tun: nativeTun},
+		probeDNS:      probeDNSServer,
+		queryFirewall: queryFirewallRules,
+		pmtuTarget:    pmtuProbeTarget(logf),
+		probePMTU:     pingDF,
+		dnsTimeout:    envDuration(logf, dnsTimeoutEnv),
+		dnsDrift:      make(chan struct{}, 1),
 	}, nil
 }
 
 func (r *winRouter) Up() error {
 	r.firewall.clear()
 
-	var err error
+	r.mu.Lock()
+	if r.unregisterChecks == nil && r.ctx.Err() == nil {
+		r.unregisterChecks = []func(){
+			health.RegisterTUNCheck(r.tunHealth),
+			health.RegisterTUNDownCheck(r.tunUpHealth),
+			health.RegisterMagicDNSCheck(r.magicDNSHealth),
+			health.RegisterDNSUpstreamCheck(r.dnsUpstreamHealth),
+			health.RegisterDNSOverriddenCheck(r.dnsOverriddenHealth),
+			health.RegisterFirewallRuleLeakCheck(r.firewallLeakHealth),
+			health.RegisterFirewallProfileMismatchCheck(r.firewallProfileHealth),
+			health.RegisterPMTUBlackholeCheck(r.pmtuHealth),
+		}
+		r.bg.Add(1)
+		go func() {
+			defer r.bg.Done()
+			r.reconcileDNS()
+		}()
+	}
+	r.mu.Unlock()
+
+	if err := r.startRouteMonitor(); err != nil {
+		// Without the monitor we only miss MTU updates, and
+		// winipcfg failures are often transient, so don't keep
+		// the tunnel down over it.
+		r.logf("%v; retrying in background", err)
+		health.SetRouteMonitorHealth(err)
+		r.bg.Add(1)
+		go func() {
+			defer r.bg.Done()
+			r.retryRouteMonitor(err)
+		}()
+		return nil
+	}
+	health.SetRouteMonitorHealth(nil)
+	return nil
+}
+
+// upWaitInterval is how often UpAndWait checks whether the router is
+// ready.
+var upWaitInterval = 250 * time.Millisecond // var for tests
+
+// UpAndWait is like Up, but then waits until the router is ready to
+// carry traffic, for orchestration code that needs a readiness gate:
+// a Config has been applied, the TUN interface exists with its link
+// up, the Config's addresses are bound to it, and the firewall rules
+// for them are in place. It returns an error saying what wasn't ready
+// if ctx ends first.
+//
+// Like Up, it's called before the first Set, so that Set must come
+// from another goroutine while it waits.
+func (r *winRouter) UpAndWait(ctx context.Context) error {
+	if err := r.Up(); err != nil {
+		return err
+	}
+	for {
+		err := r.readyErr()
+		if err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("router not ready: %v", err)
+		case <-r.ctx.Done():
+			return errors.New("router closed")
+		case <-time.After(upWaitInterval):
+		}
+	}
+	if err := r.firewall.waitKnown(ctx); err != nil {
+		return fmt.Errorf("router not ready: firewall rules not applied: %v", err)
+	}
+	return nil
+}
+
+// readyErr returns why the interface isn't ready for UpAndWait yet, or
+// nil if it is.
+func (r *winRouter) readyErr() error {
+	r.mu.Lock()
+	cfg := r.lastCfg
+	r.mu.Unlock()
+	if cfg == nil {
+		return errors.New("no config applied yet")
+	}
+	if err := r.ifc.Exists(); err != nil {
+		return err
+	}
+	if up, err := r.ifc.OperUp(); err != nil {
+		return err
+	} else if !up {
+		return errors.New("TUN interface link is down")
+	}
+	addrs, err := r.ifc.Addrs()
+	if err != nil {
+		return err
+	}
+	bound := map[netaddr.IP]bool{}
+	for _, ip := range addrs {
+		bound[ip] = true
+	}
+	v6Disabled := health.IPv6DisabledHealth() != nil
+	for _, la := range cfg.LocalAddrs {
+		if la.IP.Is6() && v6Disabled {
+			// Left out of the interface config; see ifaceConfig.
+			continue
+		}
+		if !bound[la.IP] {
+			return fmt.Errorf("address %v not bound yet", la.IP)
+		}
+	}
+	return nil
+}
+
+// startRouteMonitor starts monitoring default route changes.
+func (r *winRouter) startRouteMonitor() error {
 	t0 := time.Now()
-	r.routeChangeCallback, err = monitorDefaultRoutes(r.nativeTun)
+	cb, err := r.ifc.MonitorRoutes()
 	d := time.Since(t0).Round(time.Millisecond)
 	if err != nil {
 		return fmt.Errorf("monitorDefaultRoutes, after %v: %v", d, err)
 	}
 	r.logf("monitorDefaultRoutes done after %v", d)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ctx.Err() != nil {
+		// Close already ran and won't unregister it.
+		if cb != nil {
+			cb.Unregister()
+		}
+		return nil
+	}
+	r.routeChangeCallback = cb
 	return nil
 }
 
+// permanentAfterFailures is how many consecutive failed attempts the
+// router's background retries make before reporting their error to
+// health as permanent. They keep retrying after that.
+const permanentAfterFailures = 5
+
+// retryRouteMonitor calls startRouteMonitor with backoff until it
+// succeeds or the router is closed. err is the error from the
+// initial attempt. After permanentAfterFailures failed attempts, the
+// "route-monitor" error is reported as permanent, so that a monitor
+// that never starts doesn't look like a passing glitch.
+func (r *winRouter) retryRouteMonitor(err error) {
+	bo := backoff.NewBackoff("route-monitor", r.logf, 30*time.Second)
+	for fails := 1; ; {
+		bo.BackOff(r.ctx, err)
+		if r.ctx.Err() != nil {
+			return
+		}
+		err = r.startRouteMonitor()
+		if err == nil {
+			health.SetRouteMonitorHealth(nil)
+			return
+		}
+		fails++
+		if fails >= permanentAfterFailures {
+			health.SetPermanent("route-monitor", err)
+		} else {
+			health.SetRouteMonitorHealth(err)
+		}
+	}
+}
+
 func (r *winRouter) Set(cfg *Config) error {
 	if cfg == nil {
 		cfg = &shutdownConfig
 	}
+	atomic.AddInt64(&r.metrics.sets, 1)
+	defer func() { health.SetTUNHealth(r.tunHealth()) }()
+	if err := r.set(cfg); err != nil {
+		atomic.AddInt64(&r.metrics.setFailures, 1)
+		return err
+	}
+
+	r.mu.Lock()
+	onSet := r.onSet
+	r.mu.Unlock()
+	if onSet != nil {
+		onSet(cfg.clone())
+	}
+	return nil
+}
+
+// routerCounters are the counters behind winRouter.Metrics. They're
+// only accessed atomically, so reading them never waits for Set.
+type routerCounters struct {
+	sets, setFailures          int64
+	routesAdded, routesRemoved int64
+	addrsAdded, addrsRemoved   int64
+	interfaceFailures          int64
+	dnsApplies, dnsFailures    int64
+}
+
+// Metrics returns the router's cumulative counters. It's safe to call
+// at any time.
+func (r *winRouter) Metrics() RouterMetrics {
+	m := &r.metrics
+	return RouterMetrics{
+		Sets:              atomic.LoadInt64(&m.sets),
+		SetFailures:       atomic.LoadInt64(&m.setFailures),
+		RoutesAdded:       atomic.LoadInt64(&m.routesAdded),
+		RoutesRemoved:     atomic.LoadInt64(&m.routesRemoved),
+		AddrsAdded:        atomic.LoadInt64(&m.addrsAdded),
+		AddrsRemoved:      atomic.LoadInt64(&m.addrsRemoved),
+		InterfaceFailures: atomic.LoadInt64(&m.interfaceFailures),
+		DNSApplies:        atomic.LoadInt64(&m.dnsApplies),
+		DNSFailures:       atomic.LoadInt64(&m.dnsFailures),
+		FirewallApplies:   atomic.LoadInt64(&r.firewall.applies),
+		FirewallFailures:  atomic.LoadInt64(&r.firewall.applyFailures),
+	}
+}
+
+// countInterfaceChanges adds the routes and addresses that changed
+// between the Configs old (nil if none was applied) and new to the
+// metrics.
+func (r *winRouter) countInterfaceChanges(old, new *Config) {
+	var oldAddrs, oldRoutes []netaddr.IPPrefix
+	if old != nil {
+		oldAddrs, oldRoutes = old.LocalAddrs, old.Routes
+	}
+	added, removed := prefixesDiffCount(oldAddrs, new.LocalAddrs)
+	atomic.AddInt64(&r.metrics.addrsAdded, int64(added))
+	atomic.AddInt64(&r.metrics.addrsRemoved, int64(removed))
+	added, removed = prefixesDiffCount(oldRoutes, new.Routes)
+	atomic.AddInt64(&r.metrics.routesAdded, int64(added))
+	atomic.AddInt64(&r.metrics.routesRemoved, int64(removed))
+}
+
+// prefixesDiffCount returns how many prefixes are in new but not old,
+// and in old but not new.
+func prefixesDiffCount(old, new []netaddr.IPPrefix) (added, removed int) {
+	inOld := make(map[netaddr.IPPrefix]bool, len(old))
+	for _, p := range old {
+		inOld[p] = true
+	}
+	inNew := make(map[netaddr.IPPrefix]bool, len(new))
+	for _, p := range new {
+		inNew[p] = true
+		if !inOld[p] {
+			added++
+		}
+	}
+	for _, p := range old {
+		if !inNew[p] {
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// ReapplyAll reapplies the last Config from scratch, as if none of it
+// had been applied before: the interface is reconfigured, DNS is taken
+// down and set again, and all firewall rules are deleted and re-added.
+// It's for repairing OS state that something else changed behind the
+// router's back. It does nothing if no Config has been set.
+//
+// Like Set, it must not be called concurrently with Set.
+func (r *winRouter) ReapplyAll() error {
+	r.mu.Lock()
+	cfg := r.lastCfg
+	r.mu.Unlock()
+	if cfg == nil {
+		return nil
+	}
+	r.logf("forcing full reapply of router config")
+	r.lastNonDNSHash = [32]byte{}
+	r.dnsMu.Lock()
+	r.lastDNSOK = false
+	r.resetDNS = true
+	r.dnsMu.Unlock()
+	r.firewall.forget()
+	return r.Set(cfg)
+}
+
+// Capabilities reports the optional features of the Windows router. It
+// programs both IPv4 and IPv6, but its firewall changes are allow rules
+// only, so it has no killswitch or per-app exclusion.
+func (r *winRouter) Capabilities() RouterCapabilities {
+	return RouterCapabilities{IPv6: true}
+}
+
+// SetListenPorts sets the UDP ports the engine listens on. If the
+// Tailscale-Process rule is restricted to them (see
+// firewallRestrictProcPortsEnv), it's updated when they change.
+func (r *winRouter) SetListenPorts(ports []uint16) {
+	r.firewall.setProcPorts(append([]uint16(nil), ports...))
+}
+
+// DebugDump returns a multi-line report of the router's live state, for
+// bug reports: the TUN interface, the firewall rules it wants and has
+// applied, and the last Config applied. It's safe to call at any time.
+func (r *winRouter) DebugDump() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "tun: %s guid=%s\n", r.tunname, r.tunGUID)
+	sb.WriteString("killswitch: not supported\n")
+	r.firewall.writeState(&sb)
+	if t := r.FirewallLastApplied(); t.IsZero() {
+		sb.WriteString("firewall last applied: never\n")
+	} else {
+		fmt.Fprintf(&sb, "firewall last applied: %v\n", t.UTC().Format(time.RFC3339))
+	}
+
+	r.mu.Lock()
+	cfg := r.lastCfg
+	magicDNSServer, magicDNSName := r.magicDNSServer, r.magicDNSName
+	r.mu.Unlock()
+	if cfg == nil {
+		sb.WriteString("config: none\n")
+		return sb.String()
+	}
+	// cfg is a clone, never modified once stored; no need to hold mu.
+	fmt.Fprintf(&sb, "config:\n  local addrs: %v\n  routes: %v\n", cfg.LocalAddrs, cfg.Routes)
+	fmt.Fprintf(&sb, "  dns: nameservers=%v domains=%q proxied=%v per-domain=%v\n",
+		cfg.DNS.Nameservers, cfg.DNS.Domains, cfg.DNS.Proxied, cfg.DNS.PerDomain)
+	fmt.Fprintf(&sb, "  search domains: %q\n", cfg.SearchDomains)
+	if magicDNSServer.IsZero() {
+		sb.WriteString("magicdns probe: off\n")
+	} else {
+		fmt.Fprintf(&sb, "magicdns probe: %v for %q\n", magicDNSServer, magicDNSName)
+	}
+	return sb.String()
+}
+
+// OnSet registers fn to be called after each successful Set with a
+// copy of the Config that was applied, replacing any previous func.
+// fn is called synchronously at the end of Set and owns the copy it's
+// given. A nil fn removes the hook.
+func (r *winRouter) OnSet(fn func(*Config)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onSet = fn
+}
+
+// set is the implementation of Set.
+func (r *winRouter) set(cfg *Config) error {
+
+	// DNS changes far more often than the rest of the config (for
+	// instance on MagicDNS updates), so when nothing else changed,
+	// skip reprogramming the interface and firewall.
+	nonDNS := *cfg
+	nonDNS.DNS = dns.Config{}
+	nonDNS.SearchDomains = nil
+	sig := nonDNS.Hash()
+	dnsCfg := cfg.DNS
+	dnsCfg.Domains = mergeSearchDomains(cfg.DNS.Domains, cfg.SearchDomains)
+	health.SetDNSSplitWithoutMagicDNSWarning(splitDNSWithoutMagicDNS(cfg.DNS))
+	if sig == r.lastNonDNSHash {
+		r.setLastConfig(cfg)
+		return r.setDNS(dnsCfg)
+	}
 
 	var localAddrs []string
 	for _, la := range cfg.LocalAddrs {
 		localAddrs = append(localAddrs, la.String())
 	}
 	r.firewall.set(localAddrs)
+	r.checkRouteConflicts(cfg.Routes)
 
-	err := configureInterface(cfg, r.nativeTun)
+	r.lastNonDNSHash = [32]byte{}
+	err := r.ifc.Configure(r.ifaceConfig(r.withBlackholeRoutes(cfg)))
 	if err != nil {
+		atomic.AddInt64(&r.metrics.interfaceFailures, 1)
 		r.logf("ConfigureInterface: %v", err)
 		return err
 	}
+	if err := r.syncDNSRegistration(cfg.DisableDNSRegistration); err != nil {
+		r.logf("DNS registration: %v", err)
+		return err
+	}
+	r.lastNonDNSHash = sig
+	r.mu.Lock()
+	prev := r.lastCfg
+	r.mu.Unlock()
+	r.countInterfaceChanges(prev, cfg)
+	r.setLastConfig(cfg)
+	r.checkMTU()
 
-	if err := r.dns.Set(cfg.DNS); err != nil {
-		return fmt.Errorf("dns set: %w", err)
+	return r.setDNS(dnsCfg)
+}
+
+// checkMTU reads back the interface's MTU after Configure. Windows
+// can clamp the MTU we ask for, so when it differs that's logged and
+// recorded as the "mtu-clamped" informational entry.
+func (r *winRouter) checkMTU() {
+	requested, effective, err := r.ifc.MTU()
+	if err != nil {
+		r.logf("reading interface MTU: %v", err)
+		return
+	}
+	r.mu.Lock()
+	changed := effective != r.effectiveMTU
+	r.effectiveMTU = effective
+	r.mu.Unlock()
+
+	var clamped string
+	if requested != effective {
+		clamped = fmt.Sprintf("requested %d, effective %d", requested, effective)
+		if changed {
+			r.logf("interface MTU is %d, not the requested %d", effective, requested)
+		}
+	}
+	health.SetInfo("mtu-clamped", clamped)
+}
+
+// EffectiveMTU returns the interface's MTU as the OS reported it after
+// the last successful Set, which may be lower than requested. It
+// returns zero if it isn't known.
+func (r *winRouter) EffectiveMTU() uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.effectiveMTU
+}
+
+// blackholeGracePeriod is how long a route withdrawn from the Config
+// stays pointed into the Tailscale interface when
+// Config.BlackholeWithdrawnRoutes is set.
+var blackholeGracePeriod = 30 * time.Second // var for tests
+
+// withBlackholeRoutes returns cfg with the routes withdrawn since the
+// last applied Config added back, if cfg.BlackholeWithdrawnRoutes is
+// set. No peer's AllowedIPs cover them anymore, so wireguard-go drops
+// what's sent to them, instead of the OS sending it out the physical
+// default route unencrypted. Each is deleted again by
+// expireBlackhole after blackholeGracePeriod, unless a Config brings
+// it back first.
+//
+// Withdrawn default routes, as when an exit node is turned off, are
+// never kept: that would cut the host off entirely. Nor is anything
+// kept if cfg has no addresses, as Windows can't have interface
+// routes without one.
+func (r *winRouter) withBlackholeRoutes(cfg *Config) *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !cfg.BlackholeWithdrawnRoutes || len(cfg.LocalAddrs) == 0 {
+		// Any pending expireBlackhole finds nothing to do;
+		// Configure removes the routes itself.
+		r.blackholes = nil
+		return cfg
+	}
+	inNew := make(map[netaddr.IPPrefix]bool, len(cfg.Routes))
+	for _, p := range cfg.Routes {
+		inNew[p] = true
+		delete(r.blackholes, p)
 	}
+	now := time.Now()
+	if r.lastCfg != nil {
+		for _, p := range r.lastCfg.Routes {
+			if inNew[p] || p.Bits == 0 {
+				continue
+			}
+			if _, ok := r.blackholes[p]; ok {
+				continue
+			}
+			if r.blackholes == nil {
+				r.blackholes = map[netaddr.IPPrefix]time.Time{}
+			}
+			deadline := now.Add(blackholeGracePeriod)
+			r.blackholes[p] = deadline
+			r.logf("blackholing withdrawn route %v for %v", p, blackholeGracePeriod)
+			p := p
+			time.AfterFunc(blackholeGracePeriod, func() { r.expireBlackhole(p, deadline) })
+		}
+	}
+	if len(r.blackholes) == 0 {
+		return cfg
+	}
+	ret := cfg.clone()
+	for p := range r.blackholes {
+		ret.Routes = append(ret.Routes, p)
+	}
+	return ret
+}
+
+// expireBlackhole deletes the blackhole route p added by
+// withBlackholeRoutes with the given deadline, unless it has been
+// brought back or re-added since.
+//
+// It holds r.mu while deleting the route, so that a concurrent Set
+// that brings p back can't have its route deleted after adding it.
+func (r *winRouter) expireBlackhole(p netaddr.IPPrefix, deadline time.Time) {
+	if r.ctx.Err() != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d, ok := r.blackholes[p]; !ok || !d.Equal(deadline) {
+		return
+	}
+	delete(r.blackholes, p)
+	if err := r.ifc.DeleteRoute(p); err != nil {
+		r.logf("deleting blackhole route %v: %v", p, err)
+		return
+	}
+	r.logf("removed blackhole route %v", p)
+}
+
+// ifaceConfig returns the part of cfg that the interface can take.
+// That's all of it, unless cfg has IPv6 addresses or routes and IPv6
+// is disabled on the host: programming them would fail the whole
+// Configure, so they're left out and reported to health instead.
+//
+// The IPv6 part isn't retried if IPv6 is enabled later, until the
+// Config changes or ReapplyAll is called.
+func (r *winRouter) ifaceConfig(cfg *Config) *Config {
+	var v6Err error
+	defer func() { health.SetIPv6DisabledHealth(v6Err) }()
+	if !hasIPv6(cfg) {
+		return cfg
+	}
+	enabled, err := r.ifc.IPv6Enabled()
+	if err != nil {
+		r.logf("checking for IPv6: %v", err)
+		return cfg
+	}
+	if enabled {
+		return cfg
+	}
+	r.logf("IPv6 is disabled on this host; applying only the IPv4 config")
+	v6Err = errors.New("IPv6 is disabled on this host, so Tailscale IPv6 addresses and routes can't be used; enable IPv6 in the network adapter settings or registry to use them")
+	return withoutIPv6(cfg)
+}
+
+// checkRouteConflicts sets the "route-conflict" warning if any of
+// routes overlaps a subnet one of the host's other interfaces is on.
+// Traffic to the overlap then goes one way or the other depending on
+// route metrics, which breaks subtly. The routes are applied anyway.
+func (r *winRouter) checkRouteConflicts(routes []netaddr.IPPrefix) {
+	subnets, err := r.ifc.OtherSubnets()
+	if err != nil {
+		r.logf("listing local subnets: %v", err)
+		return
+	}
+	var warn error
+	if conflicts := routeConflicts(routes, subnets); len(conflicts) > 0 {
+		warn = fmt.Errorf("Tailscale routes overlap this host's local networks: %s", strings.Join(conflicts, ", "))
+	}
+	health.SetRouteConflictWarning(warn)
+}
+
+// routeConflicts returns descriptions of the routes that overlap any
+// of subnets. Default routes, as used by exit nodes, are meant to
+// cover everything and aren't counted.
+func routeConflicts(routes, subnets []netaddr.IPPrefix) []string {
+	var ret []string
+	for _, route := range routes {
+		if route.Bits == 0 {
+			continue
+		}
+		route = route.Masked()
+		for _, sn := range subnets {
+			if route.Contains(sn.IP) || sn.Contains(route.IP) {
+				ret = append(ret, fmt.Sprintf("%v (local %v)", route, sn))
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// hasIPv6 reports whether cfg has any IPv6 addresses or routes.
+func hasIPv6(cfg *Config) bool {
+	for _, list := range [][]netaddr.IPPrefix{cfg.LocalAddrs, cfg.Routes} {
+		for _, p := range list {
+			if p.IP.Is6() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withoutIPv6 returns a copy of cfg without its IPv6 addresses and
+// routes.
+func withoutIPv6(cfg *Config) *Config {
+	only4 := func(ps []netaddr.IPPrefix) []netaddr.IPPrefix {
+		var ret []netaddr.IPPrefix
+		for _, p := range ps {
+			if p.IP.Is4() {
+				ret = append(ret, p)
+			}
+		}
+		return ret
+	}
+	ret := cfg.clone()
+	ret.LocalAddrs = only4(cfg.LocalAddrs)
+	ret.Routes = only4(cfg.Routes)
+	return ret
+}
 
+// tunHealth reports whether the TUN interface still exists.
+//
+// The wintun adapter can vanish underneath us, for instance when its
+// driver is updated or uninstalled. The router can't recreate it, as
+// the device is owned by wireguard-go; this only makes the breakage
+// visible.
+func (r *winRouter) tunHealth() error {
+	return r.ifc.Exists()
+}
+
+// tunUpHealth reports whether the TUN interface's link is up once a
+// Config with addresses has been applied. Configuring it can succeed
+// while Windows still reports the adapter as disconnected, leaving its
+// addresses unusable. The link can take a moment to come up after
+// Set, so this is left to the periodic check rather than done by Set
+// itself. An interface that can't be queried is left to tunHealth.
+func (r *winRouter) tunUpHealth() error {
+	r.mu.Lock()
+	cfg := r.lastCfg
+	r.mu.Unlock()
+	if cfg == nil || len(cfg.LocalAddrs) == 0 {
+		return nil
+	}
+	up, err := r.ifc.OperUp()
+	if err != nil || up {
+		return nil
+	}
+	return errors.New("TUN interface is configured but its link is down")
+}
+
+// dnsProbeTimeout is how long probeDNSServer waits for an answer.
+const dnsProbeTimeout = 5 * time.Second
+
+// magicDNSHealth reports whether the MagicDNS resolver from the last
+// applied DNS config is answering queries. Configuring DNS on Windows
+// can succeed while queries still never reach the resolver.
+func (r *winRouter) magicDNSHealth() error {
+	r.mu.Lock()
+	server, name := r.magicDNSServer, r.magicDNSName
+	r.mu.Unlock()
+	if server.IsZero() {
+		return nil
+	}
+	return r.probeDNS(server, name)
+}
+
+// dnsUpstreamHealth reports whether the DNS servers from the last
+// applied DNS config are reachable, when the OS queries them directly.
+// With MagicDNS the upstreams are handled by the engine's resolver and
+// aren't known to the router, so nothing is probed.
+func (r *winRouter) dnsUpstreamHealth() error {
+	r.mu.Lock()
+	servers := r.dnsUpstreams
+	r.mu.Unlock()
+
+	var bad []string
+	for _, server := range servers {
+		if err := r.probeDNS(server, "."); err != nil {
+			bad = append(bad, server.String())
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("DNS servers not reachable: %s", strings.Join(bad, ", "))
+	}
 	return nil
 }
 
+// setDNSProbes sets what magicDNSHealth and dnsUpstreamHealth probe,
+// based on the DNS config that was just applied.
+func (r *winRouter) setDNSProbes(cfg dns.Config) {
+	var (
+		server    netaddr.IP
+		name      = "."
+		upstreams []netaddr.IP
+	)
+	if cfg.Proxied && len(cfg.Nameservers) > 0 {
+		server = cfg.Nameservers[0]
+		if len(cfg.Domains) > 0 {
+			name = cfg.Domains[0]
+		}
+	} else if !cfg.Proxied {
+		upstreams = append(upstreams, cfg.Nameservers...)
+	}
+	r.mu.Lock()
+	r.magicDNSServer, r.magicDNSName = server, name
+	r.dnsUpstreams = upstreams
+	r.mu.Unlock()
+	if server.IsZero() {
+		health.SetMagicDNSHealth(nil)
+	}
+	if len(upstreams) == 0 {
+		health.SetDNSUpstreamWarning(nil)
+	}
+}
+
+// probeDNSServer sends a DNS query for name to server and returns an
+// error if no response arrives. Any response counts, including
+// NXDOMAIN: the point is whether the resolver is listening.
+//
+// It doesn't use net.Resolver, which on Windows always goes through
+// the OS resolver rather than a given server.
+func probeDNSServer(server netaddr.IP, name string) error {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return err
+	}
+	id := uint16(rand.Intn(1 << 16))
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: qname, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	pkt, err := b.Finish()
+	if err != nil {
+		return err
+	}
+
+	c, err := net.Dial("udp", net.JoinHostPort(server.String(), "53"))
+	if err != nil {
+		return fmt.Errorf("DNS probe: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(dnsProbeTimeout))
+	if _, err := c.Write(pkt); err != nil {
+		return fmt.Errorf("DNS probe: %v", err)
+	}
+	buf := make([]byte, 512)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return fmt.Errorf("DNS server %v not answering: %v", server, err)
+		}
+		var p dnsmessage.Parser
+		if h, err := p.Start(buf[:n]); err == nil && h.ID == id && h.Response {
+			return nil
+		}
+	}
+}
+
+// mergeSearchDomains returns the search domains in base followed by
+// those in extra, without duplicates. Domains are compared
+// case-insensitively and ignoring any trailing dot; the first
+// spelling seen is kept.
+func mergeSearchDomains(base, extra []string) []string {
+	if len(extra) == 0 {
+		return base
+	}
+	seen := make(map[string]bool, len(base)+len(extra))
+	ret := make([]string, 0, len(base)+len(extra))
+	for _, list := range [][]string{base, extra} {
+		for _, d := range list {
+			k := strings.ToLower(strings.TrimSuffix(d, "."))
+			if k == "" || seen[k] {
+				continue
+			}
+			seen[k] = true
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+// setLastConfig records a copy of cfg as the last Config applied to
+// the interface.
+func (r *winRouter) setLastConfig(cfg *Config) {
+	c := cfg.clone()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastCfg = c
+}
+
+// ProgrammedRoute is a route the OS reports on the Tailscale interface.
+type ProgrammedRoute struct {
+	Prefix netaddr.IPPrefix
+	// Managed is whether the route is one the router added for the
+	// last applied Config, as opposed to one created by the OS or
+	// another program.
+	Managed bool
+}
+
+// Routes returns the routes currently installed on the Tailscale
+// interface.
+func (r *winRouter) Routes() ([]ProgrammedRoute, error) {
+	managed := map[netaddr.IPPrefix]bool{}
+	r.mu.Lock()
+	if r.lastCfg != nil {
+		for _, p := range r.lastCfg.Routes {
+			managed[p.Masked()] = true
+		}
+	}
+	r.mu.Unlock()
+
+	routes, err := r.ifc.Routes()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]ProgrammedRoute, len(routes))
+	for i, p := range routes {
+		ret[i] = ProgrammedRoute{Prefix: p, Managed: managed[p]}
+	}
+	return ret, nil
+}
+
+// PruneStaleRoutes removes the routes on the Tailscale interface that
+// aren't in the last applied Config, such as ones left pointing at a
+// stale gateway by a run that crashed. Routes Windows creates for the
+// interface's own addresses, and multicast and link-local ones, are
+// kept. Only the Tailscale interface is touched.
+//
+// It does nothing until a Config has been applied, since every route
+// would look stale. It returns how many routes were removed; on
+// error, the rest are still attempted.
+func (r *winRouter) PruneStaleRoutes() (removed int, err error) {
+	keep := map[netaddr.IPPrefix]bool{}
+	r.mu.Lock()
+	if r.lastCfg == nil {
+		r.mu.Unlock()
+		return 0, nil
+	}
+	for _, p := range r.lastCfg.Routes {
+		keep[p.Masked()] = true
+	}
+	for _, la := range r.lastCfg.LocalAddrs {
+		keep[la.Masked()] = true
+		keep[netaddr.IPPrefix{IP: la.IP, Bits: la.IP.BitLen()}] = true
+	}
+	for p := range r.blackholes {
+		keep[p.Masked()] = true
+	}
+	r.mu.Unlock()
+
+	routes, err := r.ifc.Routes()
+	if err != nil {
+		return 0, err
+	}
+	var errs []error
+	for _, p := range routes {
+		if keep[p.Masked()] || p.IP.IsMulticast() || p.IP.IsLinkLocalUnicast() || p.IP == limitedBroadcast {
+			continue
+		}
+		if err := r.ifc.DeleteRoute(p); err != nil {
+			errs = append(errs, fmt.Errorf("deleting route %v: %w", p, err))
+			continue
+		}
+		r.logf("pruned stale route %v", p)
+		removed++
+	}
+	return removed, multierror.New(errs)
+}
+
+// limitedBroadcast is the broadcast address Windows routes to every
+// IPv4 interface.
+var limitedBroadcast = netaddr.IPv4(255, 255, 255, 255)
+
+// splitDNSWithoutMagicDNS returns an error if cfg routes DNS for some
+// domains to its nameservers without MagicDNS. The Windows DNS manager
+// can't scope nameservers to domains itself; only the MagicDNS
+// resolver can, so those domains won't resolve as intended. The rest
+// of cfg is still applied.
+func splitDNSWithoutMagicDNS(cfg dns.Config) error {
+	if cfg.Proxied || !cfg.PerDomain || len(cfg.Domains) == 0 || len(cfg.Nameservers) == 0 {
+		return nil
+	}
+	return fmt.Errorf("split DNS is configured for %s but MagicDNS is disabled, so those domains may not resolve; enable MagicDNS in the admin panel",
+		strings.Join(cfg.Domains, ", "))
+}
+
+// setDNS applies cfg to the DNS manager, unless it's identical to the
+// last config that was applied successfully.
+func (r *winRouter) setDNS(cfg dns.Config) error {
+	r.dnsMu.Lock()
+	defer r.dnsMu.Unlock()
+	return r.setDNSLocked(cfg)
+}
+
+// setDNSLocked is setDNS with r.dnsMu held.
+func (r *winRouter) setDNSLocked(cfg dns.Config) error {
+	if r.lastDNSOK && r.lastDNS.Equal(cfg) {
+		return nil
+	}
+	r.lastDNSOK = false
+	atomic.AddInt64(&r.metrics.dnsApplies, 1)
+	if r.resetDNS {
+		// Start over rather than building on whatever the failed Set
+		// left behind.
+		r.logf("reapplying DNS from scratch")
+		if err := r.callDNS(r.dns.Down); err != nil {
+			atomic.AddInt64(&r.metrics.dnsFailures, 1)
+			return fmt.Errorf("dns down: %w", err)
+		}
+	}
+	if err := r.callDNS(func() error { return r.dns.Set(cfg) }); err != nil {
+		atomic.AddInt64(&r.metrics.dnsFailures, 1)
+		r.resetDNS = true
+		return fmt.Errorf("dns set: %w", err)
+	}
+	r.resetDNS = false
+	r.lastDNS = cfg
+	r.lastDNSOK = true
+	r.dnsReapplyErr = nil
+	r.setDNSProbes(cfg)
+	return nil
+}
+
+// dnsOverriddenHealth checks that the OS DNS config still matches the
+// last one applied. VPN clients and "network optimizer" tools are
+// known to reset it. It only reports: if the config was changed, it
+// asks reconcileDNS to apply it again, and returns a warning about the
+// other program until it stops happening.
+func (r *winRouter) dnsOverriddenHealth() error {
+	r.dnsMu.Lock()
+	defer r.dnsMu.Unlock()
+	if !r.lastDNSOK {
+		if r.dnsReapplyErr != nil {
+			return fmt.Errorf("DNS settings were changed by another program, and reapplying them failed: %v", r.dnsReapplyErr)
+		}
+		// Nothing known to compare with; the next Set
+		// reapplies anyway.
+		return nil
+	}
+	drift := r.callDNS(r.dns.Verify)
+	if drift == nil {
+		return nil
+	}
+	select {
+	case r.dnsDrift <- struct{}{}:
+	default:
+		// A reapply is already pending.
+	}
+	return fmt.Errorf("DNS settings were changed by another program and are being reapplied: %v", drift)
+}
+
+// reconcileDNS reapplies the last DNS config from scratch each time
+// dnsOverriddenHealth finds it was changed, until the router is
+// closed. It's started by Up.
+func (r *winRouter) reconcileDNS() {
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-r.dnsDrift:
+		}
+		r.dnsMu.Lock()
+		if r.lastDNSOK && r.ctx.Err() == nil {
+			r.logf("DNS config was changed behind our back; reapplying")
+			r.lastDNSOK = false
+			r.resetDNS = true
+			r.dnsReapplyErr = r.setDNSLocked(r.lastDNS)
+			if r.dnsReapplyErr != nil {
+				r.logf("reapplying DNS: %v", r.dnsReapplyErr)
+			}
+		}
+		r.dnsMu.Unlock()
+	}
+}
+
+// defaultDNSTimeout is the default for winRouter.dnsTimeout. The DNS
+// manager itself can wait up to 20 seconds for the interface's
+// registry keys to appear, so it's well above that.
+const defaultDNSTimeout = time.Minute
+
+// dnsTimeoutEnv, if set to a positive duration such as "2m", overrides
+// defaultDNSTimeout.
+const dnsTimeoutEnv = "TS_DEBUG_DNS_TIMEOUT"
+
+// callDNS calls fn, a DNS manager operation, giving up on it after
+// r.dnsTimeout. Registry and NRPT changes can hang, and shouldn't
+// block the whole reconfigure when they do. A timeout is reported as
+// the "dns-timeout" error, until a later call completes.
+//
+// An abandoned call keeps running, so while it does, callDNS waits for
+// it (within the same timeout) rather than calling the manager
+// concurrently.
+func (r *winRouter) callDNS(fn func() error) error {
+	timeout := r.dnsTimeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	if r.dnsStuck != nil {
+		select {
+		case <-r.dnsStuck:
+			r.dnsStuck = nil
+		case <-timer.C:
+			err := fmt.Errorf("previous DNS change still hasn't finished after another %v", timeout)
+			health.SetDNSTimeoutHealth(err)
+			return err
+		}
+	}
+
+	done := make(chan error, 1)
+	returned := make(chan struct{})
+	go func() {
+		done <- fn()
+		close(returned)
+	}()
+	select {
+	case err := <-done:
+		health.SetDNSTimeoutHealth(nil)
+		return err
+	case <-timer.C:
+		r.dnsStuck = returned
+		err := fmt.Errorf("DNS change timed out after %v", timeout)
+		r.logf("%v; continuing without it", err)
+		health.SetDNSTimeoutHealth(err)
+		return err
+	}
+}
+
+// Close tears down the router's OS state. It's safe to call more than
+// once; calls after the first do nothing and return the first's result.
 func (r *winRouter) Close() error {
-	r.firewall.clear()
+	r.closeOnce.Do(func() { r.closeErr = r.close() })
+	return r.closeErr
+}
 
-	if err := r.dns.Down(); err != nil {
-		return fmt.Errorf("dns down: %w", err)
+// syncDNSRegistration disables the interface's DNS registration, or
+// restores it, if disable changed since the last call. Leaving it
+// alone otherwise keeps a setting made outside Tailscale.
+func (r *winRouter) syncDNSRegistration(disable bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if disable == (r.restoreDNSRegistration != nil) {
+		return nil
+	}
+	if !disable {
+		err := r.restoreDNSRegistration()
+		r.restoreDNSRegistration = nil
+		return err
+	}
+	restore, err := r.ifc.DisableDNSRegistration()
+	if err != nil {
+		return err
 	}
+	r.restoreDNSRegistration = restore
+	return nil
+}
+
+func (r *winRouter) close() error {
+	r.firewall.shutdown()
+	r.cancel()
+	r.bg.Wait()
+
+	r.mu.Lock()
 	if r.routeChangeCallback != nil {
 		r.routeChangeCallback.Unregister()
+		r.routeChangeCallback = nil
+	}
+	if r.unregisterChecks != nil {
+		for _, unregister := range r.unregisterChecks {
+			unregister()
+		}
+		r.unregisterChecks = nil
+		health.SetTUNHealth(nil)
+		health.SetTUNDownHealth(nil)
+		health.SetRouteMonitorHealth(nil)
+		health.SetIPv6DisabledHealth(nil)
+		health.SetRouteConflictWarning(nil)
+		health.SetMagicDNSHealth(nil)
+		health.SetDNSUpstreamWarning(nil)
+		health.SetDNSOverriddenWarning(nil)
+		health.SetDNSSplitWithoutMagicDNSWarning(nil)
+		health.SetFirewallRuleLeakWarning(nil)
+		health.SetFirewallProfileMismatchWarning(nil)
+		health.SetDefaultRouteHealth(nil)
+		health.SetPMTUBlackholeWarning(nil)
+		health.SetInfo("mtu-clamped", "")
+	}
+	// Reported by the firewall goroutine, which shutdown silenced,
+	// with or without Up.
+	health.SetFirewallSlowWarning(nil)
+	health.SetFirewallProcessRuleWarning(nil)
+	health.SetPermanent("firewall", nil)
+	r.mu.Unlock()
+	if err := r.syncDNSRegistration(false); err != nil {
+		r.logf("restoring DNS registration: %v", err)
 	}
 
+	r.dnsMu.Lock()
+	r.lastDNSOK = false
+	err := r.callDNS(r.dns.Down)
+	r.dnsMu.Unlock()
+	health.SetDNSTimeoutHealth(nil)
+	if err != nil {
+		return fmt.Errorf("dns down: %w", err)
+	}
 	return nil
 }
 
@@ -120,18 +1473,86 @@ func cleanup(logf logger.Logf, interfaceName string) {
 // See https://github.com/tailscale/tailscale/issues/785.
 // So this tracks the desired state and runs the actual adjusting code asynchrounsly.
 type firewallTweaker struct {
+	// applies and applyFailures count doAsyncSet's attempts to
+	// apply rules and the ones that failed, for winRouter.Metrics.
+	// They're accessed atomically, and first for 64-bit alignment.
+	applies, applyFailures int64
+
 	logf logger.Logf
 
-	mu          sync.Mutex
-	didProcRule bool
-	running     bool     // doAsyncSet goroutine is running
-	known       bool     // firewall is in known state (in lastVal)
-	want        []string // next value we want, or "" to delete the firewall rule
-	lastVal     []string // last set value, if known
+	// netsh, if non-nil, is called instead of running netsh.exe
+	// with args. For tests.
+	netsh func(args ...string) error
+	// executable, if non-nil, is called instead of os.Executable.
+	// For tests.
+	executable func() (string, error)
+	// maxBackoff is the longest doAsyncSet waits between failed
+	// attempts. If zero, defaultFirewallMaxBackoff is used.
+	maxBackoff time.Duration
+	// restrictProcPorts is whether the Tailscale-Process rule only
+	// allows inbound UDP to procPorts, rather than to any port of
+	// our executable. The rule isn't added until procPorts is known.
+	restrictProcPorts bool
+
+	// slowest is the longest netsh call of the current doAsyncSet
+	// pass, for reportSlow. Only the doAsyncSet goroutine uses it.
+	slowest time.Duration
+	// fails is the number of consecutive failed doAsyncSet passes.
+	// It's kept across runs of the goroutine, including ones ended by
+	// a panic, so that the first success after a permanent failure
+	// clears it. Only the doAsyncSet goroutine uses it.
+	fails int
+
+	mu            sync.Mutex
+	didProcRule   bool
+	procRuleRetry time.Time  // if non-zero, don't retry the Tailscale-Process rule before then
+	procRuleFails int        // consecutive failures to find our executable
+	procPorts     []uint16   // UDP ports to restrict the Tailscale-Process rule to, if restrictProcPorts
+	procRuleDirty bool       // procPorts changed; doAsyncSet must run once more to redo the rule
+	forceClear    bool       // forget was called; doAsyncSet must clear and re-add all rules
+	running       bool       // doAsyncSet goroutine is running
+	known         bool       // firewall is in known state (in lastVal)
+	want          []string   // next value we want, or "" to delete the firewall rule
+	lastVal       []string   // last set value, if known
+	lastAppliedOK time.Time  // when an attempt last applied lastVal successfully
+	knownCond     *sync.Cond // lazily created; broadcast after each doAsyncSet attempt and when it ends
+	closed        bool       // shutdown was called; don't report to health anymore
 }
 
 func (ft *firewallTweaker) clear() { ft.set(nil) }
 
+// shutdown removes the firewall rules, like clear, and stops ft from
+// reporting to health, so that a removal still running after the
+// router is closed can't leave firewall warnings behind.
+func (ft *firewallTweaker) shutdown() {
+	ft.mu.Lock()
+	ft.closed = true
+	ft.mu.Unlock()
+	ft.clear()
+}
+
+// report calls fn, which reports the firewall's state to health,
+// unless shutdown has been called. ft.mu is held during the call, so
+// once shutdown returns, no report is in progress.
+func (ft *firewallTweaker) report(fn func()) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if !ft.closed {
+		fn()
+	}
+}
+
+// forget discards what ft knows about the installed rules, so the
+// next time the doAsyncSet goroutine runs it deletes and re-adds all
+// of them, Tailscale-Process included. It doesn't start the goroutine.
+func (ft *firewallTweaker) forget() {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.forceClear = true
+	ft.didProcRule = false
+	ft.procRuleRetry = time.Time{}
+}
+
 // set takes the IPv4 and/or IPv6 CIDRs to allow; an empty slice
 // removes the firwall rules.
 //
@@ -146,42 +1567,259 @@ func (ft *firewallTweaker) set(cidrs []string) {
 		ft.logf("marking allowed %v", cidrs)
 	}
 	ft.want = cidrs
+	// If it's already running, the doAsyncSet goroutine will check
+	// ft.want before returning.
+	ft.startLocked()
+}
+
+// startLocked starts the doAsyncSet goroutine, unless it's already
+// running.
+//
+// ft.mu must be held.
+func (ft *firewallTweaker) startLocked() {
 	if ft.running {
-		// The doAsyncSet goroutine will check ft.want
-		// before returning.
 		return
 	}
 	ft.logf("starting netsh goroutine")
 	ft.running = true
-	go ft.doAsyncSet()
+	go ft.asyncSet()
+}
+
+// firewallPanicRetryDelay is how long after a panic in doAsyncSet
+// asyncSet starts it again.
+const firewallPanicRetryDelay = 10 * time.Second
+
+// asyncSet is the body of the netsh goroutine: it runs doAsyncSet,
+// recovering from a panic in it, such as one from an exec quirk, that
+// would otherwise leave ft.running set and silently wedge all future
+// updates. After a panic the installed rules are unknown, so they're
+// all redone by the next run, whether that's started by a set or by
+// the retry scheduled here.
+//
+// doAsyncSet never calls out to netsh or os.Executable with ft.mu
+// held, so it's not held when recovering.
+func (ft *firewallTweaker) asyncSet() {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		ft.logf("netsh goroutine panicked, retrying in %v: %v\n%s", firewallPanicRetryDelay, p, debug.Stack())
+		ft.mu.Lock()
+		ft.running = false
+		ft.known = false
+		ft.condLocked().Broadcast()
+		ft.mu.Unlock()
+		time.AfterFunc(firewallPanicRetryDelay, func() {
+			ft.mu.Lock()
+			defer ft.mu.Unlock()
+			ft.startLocked()
+		})
+	}()
+	ft.doAsyncSet()
+}
+
+// waitKnown blocks until the firewall rules for the most recently set
+// value have been successfully applied, or until ctx is done.
+func (ft *firewallTweaker) waitKnown(ctx context.Context) error {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return ft.waitLocked(ctx, func() bool {
+		return ft.known && strsEqual(ft.lastVal, ft.want) && !ft.procRuleDirty && !ft.forceClear
+	})
+}
+
+// waitIdle blocks until the doAsyncSet goroutine isn't running, or
+// until ctx is done. It returns the last value the goroutine applied.
+func (ft *firewallTweaker) waitIdle(ctx context.Context) ([]string, error) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if err := ft.waitLocked(ctx, func() bool { return !ft.running }); err != nil {
+		return nil, err
+	}
+	return append([]string(nil), ft.lastVal...), nil
+}
+
+// waitLocked waits on ft.knownCond until done reports true or ctx is
+// done.
+//
+// ft.mu must be held.
+func (ft *firewallTweaker) waitLocked(ctx context.Context, done func() bool) error {
+	cond := ft.condLocked()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ft.mu.Lock()
+			cond.Broadcast()
+			ft.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	for !done() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cond.Wait()
+	}
+	return nil
 }
 
+// condLocked returns ft.knownCond, creating it if needed.
+// ft.mu must be held.
+func (ft *firewallTweaker) condLocked() *sync.Cond {
+	if ft.knownCond == nil {
+		ft.knownCond = sync.NewCond(&ft.mu)
+	}
+	return ft.knownCond
+}
+
+// slowFirewallThreshold is how long a single netsh invocation can take
+// before we report the firewall as slow in health.
+var slowFirewallThreshold = 10 * time.Second // var for tests
+
 func (ft *firewallTweaker) runFirewall(args ...string) (time.Duration, error) {
 	t0 := time.Now()
 	args = append([]string{"advfirewall", "firewall"}, args...)
-	cmd := exec.Command("netsh", args...)
-	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
-	err := cmd.Run()
-	return time.Since(t0).Round(time.Millisecond), err
+	var err error
+	if ft.netsh != nil {
+		err = ft.netsh(args...)
+	} else {
+		cmd := exec.Command("netsh", args...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+		err = cmd.Run()
+	}
+	d := time.Since(t0).Round(time.Millisecond)
+	if d > ft.slowest {
+		ft.slowest = d
+	}
+	return d, err
+}
+
+// reportSlow sets the "firewall-slow" warning if the slowest netsh
+// call of the doAsyncSet pass that just ended took longer than
+// slowFirewallThreshold, and clears it otherwise. Reporting once per
+// pass keeps the quick calls that follow a slow one from clearing the
+// warning right away.
+func (ft *firewallTweaker) reportSlow() {
+	var err error
+	if ft.slowest > slowFirewallThreshold {
+		err = fmt.Errorf("netsh took %v", ft.slowest)
+	}
+	ft.report(func() { health.SetFirewallSlowWarning(err) })
+}
+
+// defaultFirewallMaxBackoff is the default for
+// firewallTweaker.maxBackoff.
+const defaultFirewallMaxBackoff = time.Minute
+
+// firewallMaxBackoffEnv, if set to a positive duration such as "5m",
+// overrides defaultFirewallMaxBackoff, for hosts where netsh is known
+// to misbehave. Only the cap can be tuned; the backoff package fixes
+// how the delay grows up to it.
+const firewallMaxBackoffEnv = "TS_DEBUG_FIREWALL_MAX_BACKOFF"
+
+// firewallRestrictProcPortsEnv, if set to a true value, restricts the
+// Tailscale-Process rule to the UDP ports the engine listens on
+// instead of allowing any inbound UDP to tailscaled.
+const firewallRestrictProcPortsEnv = "TS_FIREWALL_RESTRICT_PROCESS_PORTS"
+
+// firewallRestrictProcPorts returns the firewallTweaker.restrictProcPorts
+// requested by the environment.
+func firewallRestrictProcPorts(logf logger.Logf) bool {
+	v := os.Getenv(firewallRestrictProcPortsEnv)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logf("ignoring %s: %v", firewallRestrictProcPortsEnv, err)
+		return false
+	}
+	return b
+}
+
+// firewallMaxBackoff returns the firewallTweaker.maxBackoff requested
+// by the environment, or zero for the default.
+func firewallMaxBackoff(logf logger.Logf) time.Duration {
+	return envDuration(logf, firewallMaxBackoffEnv)
+}
+
+// envDuration returns the positive duration in the environment
+// variable name, or zero if it's unset or invalid.
+func envDuration(logf logger.Logf, name string) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0
+	}
+	d, err := parsePositiveDuration(v)
+	if err != nil {
+		logf("ignoring %s: %v", name, err)
+		return 0
+	}
+	return d
+}
+
+func parsePositiveDuration(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%q is not positive", v)
+	}
+	return d, nil
 }
 
 func (ft *firewallTweaker) doAsyncSet() {
-	bo := backoff.NewBackoff("win-firewall", ft.logf, time.Minute)
+	maxBackoff := ft.maxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultFirewallMaxBackoff
+	}
+	bo := backoff.NewBackoff("win-firewall", ft.logf, maxBackoff)
 	ctx := context.Background()
 
 	ft.mu.Lock()
 	for { // invariant: ft.mu must be locked when beginning this block
 		val := ft.want
-		if ft.known && strsEqual(ft.lastVal, val) {
+		if ft.known && strsEqual(ft.lastVal, val) && !ft.procRuleDirty && !ft.forceClear {
 			ft.running = false
+			ft.condLocked().Broadcast()
 			ft.logf("ending netsh goroutine")
 			ft.mu.Unlock()
 			return
 		}
-		needClear := !ft.known || len(ft.lastVal) > 0 || len(val) == 0
-		needProcRule := !ft.didProcRule
+		// If we know which rules are installed, only touch the ones
+		// that changed, so inbound traffic to the CIDRs we keep is
+		// never blocked in between.
+		needClear := !ft.known || len(val) == 0 || ft.forceClear
+		add, del := val, []string(nil)
+		if !needClear {
+			add, del = cidrsDiff(ft.lastVal, val)
+		}
+		needProcRule := !ft.didProcRule && !time.Now().Before(ft.procRuleRetry) &&
+			(!ft.restrictProcPorts || len(ft.procPorts) > 0)
+		procPorts := ft.procPorts
+		ft.procRuleDirty = false
+		ft.forceClear = false
+		if needClear {
+			// Until this attempt finishes, the rules are neither
+			// lastVal nor val.
+			ft.known = false
+		}
 		ft.mu.Unlock()
+		ft.slowest = 0
 
+		for _, cidr := range del {
+			ft.logf("removing Tailscale-In rule for %v ...", cidr)
+			// As below, netsh returns an error if nothing matched,
+			// so it's ignored.
+			d, _ := ft.runFirewall(deleteInRuleArgs(cidr)...)
+			ft.logf("removed Tailscale-In rule for %v in %v", cidr, d)
+		}
 		if needClear {
 			ft.logf("clearing Tailscale-In firewall rules...")
 			// We ignore the error here, because netsh returns an error for
@@ -189,57 +1827,199 @@ func (ft *firewallTweaker) doAsyncSet() {
 			// TODO(bradfitz): care? That'd involve querying it before/after to see
 			// whether it was necessary/worked. But the output format is localized,
 			// so can't rely on parsing English. Maybe need to use OLE, not netsh.exe?
-			d, _ := ft.runFirewall("delete", "rule", "name=Tailscale-In", "dir=in")
+			d, _ := ft.runFirewall(deleteRuleArgs("Tailscale-In")...)
 			ft.logf("cleared Tailscale-In firewall rules in %v", d)
 		}
 		if needProcRule {
 			ft.logf("deleting any prior Tailscale-Process rule...")
-			d, err := ft.runFirewall("delete", "rule", "name=Tailscale-Process", "dir=in") // best effort
+			d, err := ft.runFirewall(deleteRuleArgs("Tailscale-Process")...) // best effort
 			if err == nil {
 				ft.logf("removed old Tailscale-Process rule in %v", d)
 			}
 			var exe string
-			exe, err = os.Executable()
+			exe, err = ft.findExecutable()
 			if err != nil {
-				ft.logf("failed to find Executable for Tailscale-Process rule: %v", err)
+				// Without it we can't add the rule, and it's not
+				// going to show up on the next loop either. Retry
+				// later, but carry on with the rest of the rules.
+				ft.mu.Lock()
+				ft.procRuleFails++
+				delay := procRuleRetryDelay(ft.procRuleFails)
+				ft.procRuleRetry = time.Now().Add(delay)
+				ft.mu.Unlock()
+				ft.logf("failed to find Executable for Tailscale-Process rule, retrying in %v: %v", delay, err)
+				werr := fmt.Errorf("can't find tailscaled executable to allow its UDP traffic: %v", err)
+				ft.report(func() { health.SetFirewallProcessRuleWarning(werr) })
 			} else {
 				ft.logf("adding Tailscale-Process rule to allow UDP for %q ...", exe)
-				d, err = ft.runFirewall("add", "rule", "name=Tailscale-Process",
-					"dir=in",
-					"action=allow",
-					"edge=yes",
-					"program="+exe,
-					"protocol=udp",
-					"profile=any",
-					"enable=yes",
-				)
+				d, err = ft.runFirewall(procRuleArgs(exe, procPorts)...)
 				if err != nil {
 					ft.logf("error adding Tailscale-Process rule: %v", err)
 				} else {
 					ft.mu.Lock()
 					ft.didProcRule = true
+					ft.procRuleFails = 0
+					ft.procRuleRetry = time.Time{}
 					ft.mu.Unlock()
+					ft.report(func() { health.SetFirewallProcessRuleWarning(nil) })
 					ft.logf("added Tailscale-Process rule in %v", d)
 				}
 			}
 		}
 		var err error
-		for _, cidr := range val {
+		for _, cidr := range add {
 			ft.logf("adding Tailscale-In rule to allow %v ...", cidr)
 			var d time.Duration
-			d, err = ft.runFirewall("add", "rule", "name=Tailscale-In", "dir=in", "action=allow", "localip="+cidr, "profile=private", "enable=yes")
+			d, err = ft.runFirewall(inRuleArgs(cidr, "private")...)
 			if err != nil {
 				ft.logf("error adding Tailscale-In rule to allow %v: %v", cidr, err)
 				break
 			}
 			ft.logf("added Tailscale-In rule to allow %v in %v", cidr, d)
 		}
+		ft.reportSlow()
+		atomic.AddInt64(&ft.applies, 1)
+		if err != nil {
+			atomic.AddInt64(&ft.applyFailures, 1)
+			ft.fails++
+			if ft.fails == permanentAfterFailures {
+				ft.logf("still failing after %d attempts; needs attention: %v", ft.fails, err)
+				ft.report(func() { health.SetPermanent("firewall", err) })
+			}
+		} else if ft.fails > 0 {
+			if ft.fails >= permanentAfterFailures {
+				ft.report(func() { health.SetPermanent("firewall", nil) })
+			}
+			ft.fails = 0
+		}
 		bo.BackOff(ctx, err)
 
 		ft.mu.Lock()
 		ft.lastVal = val
 		ft.known = (err == nil)
+		if ft.known {
+			ft.lastAppliedOK = time.Now()
+		}
+		ft.condLocked().Broadcast()
+	}
+}
+
+// setProcPorts sets the UDP ports the Tailscale-Process rule is
+// restricted to, and redoes the rule if they changed. It does nothing
+// unless ft.restrictProcPorts is set.
+//
+// setProcPorts takes ownership of the slice.
+func (ft *firewallTweaker) setProcPorts(ports []uint16) {
+	if !ft.restrictProcPorts {
+		return
+	}
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if uint16sEqual(ft.procPorts, ports) {
+		return
+	}
+	ft.logf("restricting Tailscale-Process rule to UDP ports %v", ports)
+	ft.procPorts = ports
+	ft.didProcRule = false
+	ft.procRuleDirty = true
+	ft.startLocked()
+}
+
+func (ft *firewallTweaker) findExecutable() (string, error) {
+	if ft.executable != nil {
+		return ft.executable()
+	}
+	return os.Executable()
+}
+
+// procRuleRetryDelay returns how long to wait before trying to add the
+// Tailscale-Process rule again after failing to find our executable
+// fails times in a row.
+func procRuleRetryDelay(fails int) time.Duration {
+	d := time.Duration(fails*fails) * time.Second
+	if d > 5*time.Minute {
+		d = 5 * time.Minute
+	}
+	return d
+}
+
+// procRuleArgs returns the "netsh advfirewall firewall" arguments to
+// add the Tailscale-Process rule, which allows inbound UDP to exe, on
+// only the given ports if any.
+func procRuleArgs(exe string, ports []uint16) []string {
+	args := []string{"add", "rule", "name=Tailscale-Process",
+		"dir=in",
+		"action=allow",
+		"edge=yes",
+		"program=" + exe,
+		"protocol=udp",
+	}
+	if len(ports) > 0 {
+		ps := make([]string, len(ports))
+		for i, p := range ports {
+			ps[i] = strconv.Itoa(int(p))
+		}
+		args = append(args, "localport="+strings.Join(ps, ","))
+	}
+	return append(args, "profile=any", "enable=yes")
+}
+
+// inRuleArgs returns the "netsh advfirewall firewall" arguments to add
+// a Tailscale-In rule allowing inbound traffic to cidr on the named
+// firewall profile.
+//
+// The rule matches on cidr regardless of interface: netsh can only
+// scope rules by interface type (lan, wireless, ras), not to a
+// particular adapter, so restricting it to the Tailscale interface
+// needs a different backend such as WFP.
+func inRuleArgs(cidr, profile string) []string {
+	return []string{"add", "rule", "name=Tailscale-In", "dir=in", "action=allow", "localip=" + cidr, "profile=" + profile, "enable=yes"}
+}
+
+// deleteRuleArgs returns the "netsh advfirewall firewall" arguments to
+// delete all inbound rules with the given name.
+func deleteRuleArgs(name string) []string {
+	return []string{"delete", "rule", "name=" + name, "dir=in"}
+}
+
+// deleteInRuleArgs returns the "netsh advfirewall firewall" arguments
+// to delete the Tailscale-In rule for cidr, leaving any others.
+func deleteInRuleArgs(cidr string) []string {
+	return append(deleteRuleArgs("Tailscale-In"), "localip="+cidr)
+}
+
+// cidrsDiff returns the CIDRs in new but not old, and those in old but
+// not new, each in their original order.
+func cidrsDiff(old, new []string) (add, del []string) {
+	inOld := make(map[string]bool, len(old))
+	for _, c := range old {
+		inOld[c] = true
 	}
+	inNew := make(map[string]bool, len(new))
+	for _, c := range new {
+		inNew[c] = true
+		if !inOld[c] {
+			add = append(add, c)
+		}
+	}
+	for _, c := range old {
+		if !inNew[c] {
+			del = append(del, c)
+		}
+	}
+	return add, del
+}
+
+func uint16sEqual(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func strsEqual(a, b []string) bool {
@@ -0,0 +1,2160 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"inet.af/netaddr"
+	"tailscale.com/health"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/router/dns"
+)
+
+// fakeDNSManager is a dnsManager that records the configs it's given.
+type fakeDNSManager struct {
+	sets    []dns.Config
+	downs   int
+	failSet error // if non-nil, returned by the next Set
+	// block, if non-nil, is received from before each Set does
+	// anything.
+	block chan struct{}
+	// drift, while non-nil, is returned by Verify.
+	drift error
+}
+
+func (m *fakeDNSManager) Verify() error { return m.drift }
+
+func (m *fakeDNSManager) Set(cfg dns.Config) error {
+	if m.block != nil {
+		<-m.block
+	}
+	m.sets = append(m.sets, cfg)
+	err := m.failSet
+	m.failSet = nil
+	return err
+}
+
+func (m *fakeDNSManager) Down() error {
+	m.downs++
+	return nil
+}
+
+// fakeNetsh records the netsh commands run by a firewallTweaker.
+type fakeNetsh struct {
+	mu   sync.Mutex
+	cmds [][]string // without the leading "advfirewall firewall"
+}
+
+func (f *fakeNetsh) run(args ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cmds = append(f.cmds, append([]string(nil), args[2:]...))
+	return nil
+}
+
+// count returns how many recorded commands start with prefix.
+func (f *fakeNetsh) count(prefix ...string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.cmds {
+		if len(c) >= len(prefix) && strsEqual(c[:len(prefix)], prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// waitKnown waits for ft to apply its most recently set value.
+func waitKnown(t *testing.T, ft *firewallTweaker) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := ft.waitKnown(ctx); err != nil {
+		t.Fatalf("firewall state never became known: %v", err)
+	}
+}
+
+// fakeIface is an ifaceConfigurator that doesn't touch the OS. Its
+// funcs, if non-nil, are called by the corresponding methods.
+type fakeIface struct {
+	configured int // number of Configure calls
+	configure  func(*Config) error
+	monitor    func() (*winipcfg.RouteChangeCallback, error)
+	exists     func() error
+	operUp     func() bool         // if nil, the link is up
+	noIPv6     bool                // whether IPv6 is disabled on the host
+	addrs      func() []netaddr.IP // returned by Addrs, if non-nil
+	category   func() int32        // returned by NetworkCategory; if nil, private
+	subnets    []netaddr.IPPrefix  // returned by OtherSubnets
+	routes     []netaddr.IPPrefix
+	mtu        uint32 // returned by DefaultRouteMTU
+	// ifaceMTU is the MTU requested for the interface, and
+	// effectiveMTU what MTU reads back; zero means the same.
+	ifaceMTU     uint32
+	effectiveMTU uint32
+	// regDisabled and regRestored count DisableDNSRegistration calls
+	// and calls to the funcs they returned.
+	regDisabled int
+	regRestored int
+}
+
+func (f *fakeIface) Configure(cfg *Config) error {
+	f.configured++
+	if f.configure != nil {
+		return f.configure(cfg)
+	}
+	return nil
+}
+
+func (f *fakeIface) MonitorRoutes() (*winipcfg.RouteChangeCallback, error) {
+	if f.monitor != nil {
+		return f.monitor()
+	}
+	return nil, nil
+}
+
+func (f *fakeIface) Exists() error {
+	if f.exists != nil {
+		return f.exists()
+	}
+	return nil
+}
+
+func (f *fakeIface) OperUp() (bool, error) {
+	if f.operUp != nil {
+		return f.operUp(), nil
+	}
+	return true, nil
+}
+
+func (f *fakeIface) IPv6Enabled() (bool, error) { return !f.noIPv6, nil }
+
+func (f *fakeIface) Addrs() ([]netaddr.IP, error) {
+	if f.addrs != nil {
+		return f.addrs(), nil
+	}
+	return nil, nil
+}
+
+func (f *fakeIface) OtherSubnets() ([]netaddr.IPPrefix, error) { return f.subnets, nil }
+
+func (f *fakeIface) Routes() ([]netaddr.IPPrefix, error) { return f.routes, nil }
+
+func (f *fakeIface) DeleteRoute(p netaddr.IPPrefix) error {
+	for i, route := range f.routes {
+		if route == p {
+			f.routes = append(f.routes[:i:i], f.routes[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no route to %v", p)
+}
+
+func (f *fakeIface) DefaultRouteMTU() (uint32, error) { return f.mtu, nil }
+
+func (f *fakeIface) NetworkCategory() (int32, error) {
+	if f.category != nil {
+		return f.category(), nil
+	}
+	return categoryPrivate, nil
+}
+
+func (f *fakeIface) DisableDNSRegistration() (restore func() error, err error) {
+	f.regDisabled++
+	return func() error {
+		f.regRestored++
+		return nil
+	}, nil
+}
+
+func (f *fakeIface) MTU() (requested, effective uint32, err error) {
+	if f.effectiveMTU == 0 {
+		return f.ifaceMTU, f.ifaceMTU, nil
+	}
+	return f.ifaceMTU, f.effectiveMTU, nil
+}
+
+// newTestRouter returns a winRouter that doesn't touch the OS, along
+// with its fake DNS manager and interface.
+func newTestRouter(t *testing.T) (r *winRouter, dm *fakeDNSManager, ifc *fakeIface) {
+	dm = new(fakeDNSManager)
+	ifc = new(fakeIface)
+	// The router reports to the global health state; don't let one
+	// test's errors leak into the next. Cleanups run last first, so
+	// this runs after cancel.
+	t.Cleanup(health.Reset)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	r = &winRouter{
+		logf:   t.Logf,
+		dns:    dm,
+		ctx:    ctx,
+		cancel: cancel,
+		firewall: &firewallTweaker{
+			logf:  logger.Discard,
+			netsh: func(...string) error { return nil },
+		},
+		ifc:      ifc,
+		probeDNS: func(netaddr.IP, string) error { return nil },
+		dnsDrift: make(chan struct{}, 1),
+	}
+	return r, dm, ifc
+}
+
+func mustIPPrefix(t *testing.T, s string) netaddr.IPPrefix {
+	t.Helper()
+	ipp, err := netaddr.ParseIPPrefix(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipp
+}
+
+func TestSetDNSOnlyChange(t *testing.T) {
+	r, dm, ifc := newTestRouter(t)
+
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		Routes:     []netaddr.IPPrefix{mustIPPrefix(t, "100.64.0.0/10")},
+		DNS:        dns.Config{Domains: []string{"foo.example"}},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg2 := *cfg
+	cfg2.DNS = dns.Config{Domains: []string{"bar.example"}}
+	if err := r.Set(&cfg2); err != nil {
+		t.Fatal(err)
+	}
+	if ifc.configured != 1 {
+		t.Errorf("interface configured %d times; want 1", ifc.configured)
+	}
+	if len(dm.sets) != 2 {
+		t.Fatalf("dns set %d times; want 2", len(dm.sets))
+	}
+	if got := dm.sets[1].Domains[0]; got != "bar.example" {
+		t.Errorf("last dns domain = %q; want bar.example", got)
+	}
+
+	cfg3 := cfg2
+	cfg3.Routes = nil
+	if err := r.Set(&cfg3); err != nil {
+		t.Fatal(err)
+	}
+	if ifc.configured != 2 {
+		t.Errorf("interface configured %d times after route change; want 2", ifc.configured)
+	}
+}
+
+func TestSetSkipsIdenticalDNS(t *testing.T) {
+	r, dm, _ := newTestRouter(t)
+
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		DNS:        dns.Config{Domains: []string{"foo.example"}},
+	}
+	steps := []struct {
+		routes  []netaddr.IPPrefix
+		domains []string
+		wantSet int // cumulative dns.Set calls
+	}{
+		{nil, []string{"foo.example"}, 1},
+		{nil, []string{"foo.example"}, 1},
+		{[]netaddr.IPPrefix{mustIPPrefix(t, "100.64.0.0/10")}, []string{"foo.example"}, 1},
+		{nil, []string{"bar.example"}, 2},
+		{nil, []string{"bar.example"}, 2},
+	}
+	for i, st := range steps {
+		c := *cfg
+		c.Routes = st.routes
+		c.DNS = dns.Config{Domains: st.domains}
+		if err := r.Set(&c); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if len(dm.sets) != st.wantSet {
+			t.Errorf("step %d: dns set %d times; want %d", i, len(dm.sets), st.wantSet)
+		}
+	}
+}
+
+func TestSetDNSReappliesAfterFailure(t *testing.T) {
+	r, dm, _ := newTestRouter(t)
+
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		DNS:        dns.Config{Domains: []string{"foo.example"}},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := *cfg
+	bad.DNS = dns.Config{Domains: []string{"bar.example"}}
+	dm.failSet = errors.New("registry write failed")
+	if err := r.Set(&bad); err == nil {
+		t.Fatal("Set succeeded despite dns.Set failing")
+	}
+	if dm.downs != 0 {
+		t.Fatalf("dns brought down %d times before any retry; want 0", dm.downs)
+	}
+
+	// Going back to the last good config must not be skipped, and
+	// must start from a clean slate.
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if dm.downs != 1 {
+		t.Errorf("dns brought down %d times on retry; want 1", dm.downs)
+	}
+	if len(dm.sets) != 3 || !dm.sets[2].Equal(cfg.DNS) {
+		t.Errorf("dns sets = %+v; want a third Set of %+v", dm.sets, cfg.DNS)
+	}
+
+	// Once it succeeded, it's back to skipping identical configs.
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if dm.downs != 1 || len(dm.sets) != 3 {
+		t.Errorf("after recovery: %d downs, %d sets; want 1, 3", dm.downs, len(dm.sets))
+	}
+}
+
+func TestReapplyAll(t *testing.T) {
+	r, dm, ifc := newTestRouter(t)
+	netsh := new(fakeNetsh)
+	r.firewall.netsh = netsh.run
+	r.firewall.executable = func() (string, error) { return `C:\tailscaled.exe`, nil }
+
+	if err := r.ReapplyAll(); err != nil {
+		t.Fatalf("ReapplyAll before any Set: %v", err)
+	}
+	if ifc.configured != 0 || len(dm.sets) != 0 {
+		t.Fatalf("ReapplyAll before any Set applied something: %d configures, %d dns sets", ifc.configured, len(dm.sets))
+	}
+
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		DNS:        dns.Config{Domains: []string{"foo.example"}},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	waitKnown(t, r.firewall)
+
+	// Nothing changed, but every step must run again.
+	if err := r.ReapplyAll(); err != nil {
+		t.Fatal(err)
+	}
+	waitKnown(t, r.firewall)
+	if ifc.configured != 2 {
+		t.Errorf("interface configured %d times; want 2", ifc.configured)
+	}
+	if dm.downs != 1 {
+		t.Errorf("dns brought down %d times; want 1", dm.downs)
+	}
+	if len(dm.sets) != 2 || !dm.sets[1].Equal(dm.sets[0]) {
+		t.Errorf("dns sets = %+v; want the same config set twice", dm.sets)
+	}
+	if n := netsh.count(deleteRuleArgs("Tailscale-In")...); n != 2 {
+		t.Errorf("Tailscale-In rules cleared %d times; want 2", n)
+	}
+	if n := netsh.count(inRuleArgs("100.101.102.103/32", "private")...); n != 2 {
+		t.Errorf("Tailscale-In rule added %d times; want 2", n)
+	}
+	if n := netsh.count(deleteRuleArgs("Tailscale-Process")...); n != 2 {
+		t.Errorf("Tailscale-Process rule redone %d times; want 2", n)
+	}
+
+	// Afterwards, identical configs are skipped again.
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if ifc.configured != 2 || len(dm.sets) != 2 {
+		t.Errorf("after ReapplyAll: %d configures, %d dns sets; want 2, 2", ifc.configured, len(dm.sets))
+	}
+}
+
+func TestEffectiveMTU(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	ifc.ifaceMTU = 1280
+	ifc.effectiveMTU = 1200
+
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.EffectiveMTU(); got != 1200 {
+		t.Errorf("EffectiveMTU = %d; want 1200", got)
+	}
+	if got, want := health.Info()["mtu-clamped"], "requested 1280, effective 1200"; got != want {
+		t.Errorf("mtu-clamped = %q; want %q", got, want)
+	}
+
+	ifc.effectiveMTU = 0
+	cfg.Routes = []netaddr.IPPrefix{mustIPPrefix(t, "100.64.0.0/10")}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.EffectiveMTU(); got != 1280 {
+		t.Errorf("EffectiveMTU = %d; want 1280", got)
+	}
+	if got, ok := health.Info()["mtu-clamped"]; ok {
+		t.Errorf("mtu-clamped = %q after MTU applied as requested", got)
+	}
+}
+
+func TestDNSOverridden(t *testing.T) {
+	r, dm, _ := newTestRouter(t)
+	if err := r.Up(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// dm is used by reconcileDNS with r.dnsMu held.
+	withDNS := func(f func()) {
+		r.dnsMu.Lock()
+		defer r.dnsMu.Unlock()
+		f()
+	}
+	// reapplied waits for reconcileDNS to have applied DNS n times
+	// in all.
+	reapplied := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			var sets int
+			withDNS(func() { sets = len(dm.sets) })
+			if sets >= n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("dns sets = %d; want %d", sets, n)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	withDNS(func() { dm.drift = errors.New(`NameServer is "8.8.8.8"`) })
+	if err := r.dnsOverriddenHealth(); err != nil {
+		t.Errorf("before any DNS was applied: %v", err)
+	}
+
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		DNS: dns.Config{
+			Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+			Domains:     []string{"foo.example"},
+		},
+	}
+	withDNS(func() { dm.drift = nil })
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.dnsOverriddenHealth(); err != nil {
+		t.Errorf("with DNS as applied: %v", err)
+	}
+	reapplied(1)
+
+	withDNS(func() { dm.drift = errors.New(`NameServer is "8.8.8.8"`) })
+	if err := r.dnsOverriddenHealth(); err == nil {
+		t.Error("overridden DNS not reported")
+	}
+	// Reapplied from scratch by reconcileDNS, not by the check.
+	reapplied(2)
+	withDNS(func() {
+		if dm.downs != 1 || len(dm.sets) != 2 || !dm.sets[1].Equal(cfg.DNS) {
+			t.Errorf("after override: %d downs, sets %+v; want 1 down and a set of %+v", dm.downs, dm.sets, cfg.DNS)
+		}
+		dm.drift = nil
+	})
+	if err := r.dnsOverriddenHealth(); err != nil {
+		t.Errorf("after reapplying: %v", err)
+	}
+	// A Set with the same DNS doesn't need to apply it again.
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	withDNS(func() {
+		if len(dm.sets) != 2 {
+			t.Errorf("dns sets = %d after unchanged Set; want 2", len(dm.sets))
+		}
+	})
+
+	// A failed reapply is reported until DNS is applied again.
+	withDNS(func() {
+		dm.drift = errors.New(`NameServer is "8.8.8.8"`)
+		dm.failSet = errors.New("registry write failed")
+	})
+	if err := r.dnsOverriddenHealth(); err == nil {
+		t.Error("overridden DNS not reported")
+	}
+	reapplied(3)
+	if err := r.dnsOverriddenHealth(); err == nil || !strings.Contains(err.Error(), "registry write failed") {
+		t.Errorf("after failed reapply: %v; want the failure", err)
+	}
+}
+
+func TestSplitDNSWithoutMagicDNS(t *testing.T) {
+	r, dm, _ := newTestRouter(t)
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		DNS: dns.Config{
+			Nameservers: []netaddr.IP{netaddr.MustParseIP("10.0.0.53")},
+			Domains:     []string{"corp.example"},
+			PerDomain:   true,
+		},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if sev := health.SeverityOf("dns-split-without-magicdns"); sev != health.SeverityWarning {
+		t.Errorf("severity with split DNS and no MagicDNS = %v; want %v", sev, health.SeverityWarning)
+	}
+	// What can be applied still is.
+	if len(dm.sets) != 1 || !dm.sets[0].Equal(cfg.DNS) {
+		t.Errorf("dns sets = %+v; want one of %+v", dm.sets, cfg.DNS)
+	}
+
+	cfg.DNS.Proxied = true
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if sev := health.SeverityOf("dns-split-without-magicdns"); sev != 0 {
+		t.Errorf("severity with MagicDNS = %v; want cleared", sev)
+	}
+}
+
+func TestSetDNSTimeout(t *testing.T) {
+	r, dm, _ := newTestRouter(t)
+	r.dnsTimeout = 20 * time.Millisecond
+	block := make(chan struct{})
+	dm.block = block
+
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		DNS:        dns.Config{Domains: []string{"foo.example"}},
+	}
+	if err := r.Set(cfg); err == nil {
+		t.Fatal("Set succeeded with dns.Set hung")
+	}
+	if health.DNSTimeoutHealth() == nil {
+		t.Error("hung dns.Set not reported")
+	}
+
+	// While it's still hung, the manager isn't called again.
+	other := *cfg
+	other.DNS = dns.Config{Domains: []string{"bar.example"}}
+	if err := r.Set(&other); err == nil {
+		t.Fatal("Set succeeded with previous dns.Set still hung")
+	}
+
+	close(block)
+	if err := r.Set(&other); err != nil {
+		t.Fatalf("Set after dns.Set returned: %v", err)
+	}
+	if err := health.DNSTimeoutHealth(); err != nil {
+		t.Errorf("after recovery: %v", err)
+	}
+	// The hung Set, then the new one, started over after a Down.
+	if len(dm.sets) != 2 || !dm.sets[1].Equal(other.DNS) {
+		t.Errorf("dns sets = %+v; want the hung one and %+v", dm.sets, other.DNS)
+	}
+	if dm.downs != 1 {
+		t.Errorf("dns brought down %d times; want 1", dm.downs)
+	}
+}
+
+func TestSetSearchDomains(t *testing.T) {
+	r, dm, _ := newTestRouter(t)
+
+	cfg := &Config{
+		LocalAddrs:    []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		DNS:           dns.Config{Domains: []string{"foo.beta.tailscale.net", "corp.example"}},
+		SearchDomains: []string{"Corp.Example.", "eng.corp.example", "", "eng.corp.example"},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(dm.sets) != 1 {
+		t.Fatalf("dns set %d times; want 1", len(dm.sets))
+	}
+	want := []string{"foo.beta.tailscale.net", "corp.example", "eng.corp.example"}
+	if got := dm.sets[0].Domains; !strsEqual(got, want) {
+		t.Errorf("domains = %q; want %q", got, want)
+	}
+
+	// Changing only the extra search domains only touches DNS.
+	cfg2 := *cfg
+	cfg2.SearchDomains = nil
+	if err := r.Set(&cfg2); err != nil {
+		t.Fatal(err)
+	}
+	if len(dm.sets) != 2 {
+		t.Fatalf("dns set %d times; want 2", len(dm.sets))
+	}
+	if got := dm.sets[1].Domains; !strsEqual(got, cfg.DNS.Domains) {
+		t.Errorf("domains = %q; want %q", got, cfg.DNS.Domains)
+	}
+}
+
+func TestOnSet(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	var got []*Config
+	r.OnSet(func(c *Config) { got = append(got, c) })
+
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		DNS:        dns.Config{Domains: []string{"foo.example"}},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] == cfg || got[0].DNS.Domains[0] != "foo.example" {
+		t.Fatalf("OnSet got %+v; want a copy of %+v", got, cfg)
+	}
+	got[0].LocalAddrs[0] = mustIPPrefix(t, "100.64.0.1/32")
+	if cfg.LocalAddrs[0] != mustIPPrefix(t, "100.101.102.103/32") {
+		t.Error("OnSet callback's Config aliases the caller's")
+	}
+
+	// DNS-only changes are reported too.
+	cfg2 := *cfg
+	cfg2.DNS = dns.Config{Domains: []string{"bar.example"}}
+	if err := r.Set(&cfg2); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1].DNS.Domains[0] != "bar.example" {
+		t.Fatalf("after DNS change, OnSet got %+v", got)
+	}
+
+	// Failed Sets aren't.
+	ifc.configure = func(*Config) error { return errors.New("boom") }
+	cfg3 := cfg2
+	cfg3.Routes = []netaddr.IPPrefix{mustIPPrefix(t, "100.64.0.0/10")}
+	if err := r.Set(&cfg3); err == nil {
+		t.Fatal("Set succeeded with failing configure")
+	}
+	if len(got) != 2 {
+		t.Errorf("OnSet called %d times; want 2", len(got))
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	ifc.routes = []netaddr.IPPrefix{
+		mustIPPrefix(t, "100.64.0.0/10"),
+		mustIPPrefix(t, "10.0.0.0/8"),
+	}
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		Routes:     []netaddr.IPPrefix{mustIPPrefix(t, "100.64.0.0/10")},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.Routes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ProgrammedRoute{
+		{Prefix: mustIPPrefix(t, "100.64.0.0/10"), Managed: true},
+		{Prefix: mustIPPrefix(t, "10.0.0.0/8"), Managed: false},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Routes = %+v; want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Routes[%d] = %+v; want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPruneStaleRoutes(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	if n, err := r.PruneStaleRoutes(); n != 0 || err != nil {
+		t.Fatalf("before Set: PruneStaleRoutes = %d, %v; want 0, nil", n, err)
+	}
+
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{
+			mustIPPrefix(t, "100.101.102.103/32"),
+			mustIPPrefix(t, "fd7a:115c:a1e0::1/128"),
+		},
+		Routes: []netaddr.IPPrefix{mustIPPrefix(t, "100.64.0.0/10")},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ifc.routes = []netaddr.IPPrefix{
+		mustIPPrefix(t, "100.64.0.0/10"),
+		mustIPPrefix(t, "10.0.0.0/8"), // stale
+		mustIPPrefix(t, "100.101.102.103/32"),
+		mustIPPrefix(t, "fd7a:115c:a1e0::1/128"),
+		mustIPPrefix(t, "fd7a:115c:a1e0:ab12::/64"), // stale
+		mustIPPrefix(t, "224.0.0.0/4"),
+		mustIPPrefix(t, "255.255.255.255/32"),
+		mustIPPrefix(t, "fe80::/64"),
+		mustIPPrefix(t, "ff00::/8"),
+	}
+	n, err := r.PruneStaleRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("PruneStaleRoutes removed %d routes; want 2", n)
+	}
+	want := []netaddr.IPPrefix{
+		mustIPPrefix(t, "100.64.0.0/10"),
+		mustIPPrefix(t, "100.101.102.103/32"),
+		mustIPPrefix(t, "fd7a:115c:a1e0::1/128"),
+		mustIPPrefix(t, "224.0.0.0/4"),
+		mustIPPrefix(t, "255.255.255.255/32"),
+		mustIPPrefix(t, "fe80::/64"),
+		mustIPPrefix(t, "ff00::/8"),
+	}
+	if !prefixesEqual(ifc.routes, want) {
+		t.Errorf("routes after pruning = %v; want %v", ifc.routes, want)
+	}
+
+	// Nothing left to prune.
+	if n, err := r.PruneStaleRoutes(); n != 0 || err != nil {
+		t.Errorf("second PruneStaleRoutes = %d, %v; want 0, nil", n, err)
+	}
+}
+
+func TestBlackholeWithdrawnRoutes(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	defer func(d time.Duration) { blackholeGracePeriod = d }(blackholeGracePeriod)
+	blackholeGracePeriod = 50 * time.Millisecond
+
+	// ifc.routes is what's programmed: written by Configure from the
+	// test goroutine, and by expireBlackhole with r.mu held.
+	ifc.configure = func(cfg *Config) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		ifc.routes = append([]netaddr.IPPrefix(nil), cfg.Routes...)
+		return nil
+	}
+	programmed := func() []netaddr.IPPrefix {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return append([]netaddr.IPPrefix(nil), ifc.routes...)
+	}
+
+	cgnat := mustIPPrefix(t, "100.64.0.0/10")
+	subnet := mustIPPrefix(t, "10.1.0.0/16")
+	cfg := &Config{
+		LocalAddrs:               []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		Routes:                   []netaddr.IPPrefix{cgnat, subnet, mustIPPrefix(t, "0.0.0.0/0")},
+		BlackholeWithdrawnRoutes: true,
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Routes = []netaddr.IPPrefix{cgnat}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	// The withdrawn subnet is still routed into the tunnel; the
+	// withdrawn default route isn't.
+	if got, want := programmed(), []netaddr.IPPrefix{cgnat, subnet}; !prefixesEqual(got, want) {
+		t.Errorf("routes after withdrawal = %v; want %v", got, want)
+	}
+	r.mu.Lock()
+	last := r.lastCfg.Routes
+	r.mu.Unlock()
+	if !prefixesEqual(last, cfg.Routes) {
+		t.Errorf("lastCfg.Routes = %v; want %v", last, cfg.Routes)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for want := []netaddr.IPPrefix{cgnat}; !prefixesEqual(programmed(), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("routes after grace period = %v; want %v", programmed(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestUpAndWait(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	defer func(d time.Duration) { upWaitInterval = d }(upWaitInterval)
+	upWaitInterval = time.Millisecond
+
+	var (
+		mu    sync.Mutex
+		bound []netaddr.IP
+	)
+	ifc.addrs = func() []netaddr.IP {
+		mu.Lock()
+		defer mu.Unlock()
+		return bound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err := r.UpAndWait(ctx)
+	cancel()
+	if err == nil || !strings.Contains(err.Error(), "no config applied yet") {
+		t.Fatalf("UpAndWait before Set = %v; want not-ready error", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		done <- r.UpAndWait(ctx)
+	}()
+	notDone := func(what string) {
+		t.Helper()
+		select {
+		case err := <-done:
+			t.Fatalf("UpAndWait returned %v %s", err, what)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	notDone("before Set")
+
+	addr := mustIPPrefix(t, "100.101.102.103/32")
+	if err := r.Set(&Config{LocalAddrs: []netaddr.IPPrefix{addr}}); err != nil {
+		t.Fatal(err)
+	}
+	notDone("before the address was bound")
+
+	mu.Lock()
+	bound = []netaddr.IP{addr.IP}
+	mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("UpAndWait = %v; want ready", err)
+	}
+	if got, _ := r.firewall.waitIdle(context.Background()); !strsEqual(got, []string{addr.String()}) {
+		t.Errorf("firewall rules = %v; want %v", got, addr)
+	}
+}
+
+func TestUpRetriesRouteMonitor(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+
+	retried := make(chan bool)
+	release := make(chan bool)
+	calls := 0
+	ifc.monitor = func() (*winipcfg.RouteChangeCallback, error) {
+		calls++
+		if calls == 1 {
+			return nil, errors.New("transient failure")
+		}
+		retried <- true
+		<-release
+		return nil, nil
+	}
+
+	if err := r.Up(); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	if err := health.RouteMonitorHealth(); err == nil {
+		t.Error("no route-monitor health error after failure")
+	}
+	select {
+	case <-retried:
+	case <-time.After(10 * time.Second):
+		t.Fatal("route monitor not retried")
+	}
+	close(release)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for health.RouteMonitorHealth() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("route-monitor health error not cleared after retry succeeded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRouteMonitorRetryPermanent(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	ifc.monitor = func() (*winipcfg.RouteChangeCallback, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return nil, errors.New("access denied")
+	}
+	if err := r.Up(); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for health.SeverityOf("route-monitor") != health.SeverityPermanent {
+		if time.Now().After(deadline) {
+			t.Fatalf("route-monitor severity = %v; want permanent", health.SeverityOf("route-monitor"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Close waits for the retries to stop.
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	n := calls
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != n {
+		t.Errorf("route monitor retried %d more times after Close", calls-n)
+	}
+}
+
+func TestTUNMissing(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	var (
+		mu   sync.Mutex
+		gone = true
+	)
+	ifc.exists = func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if gone {
+			return errors.New("interface gone")
+		}
+		return nil
+	}
+	if err := r.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")}}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if health.TUNHealth() == nil {
+		t.Fatal("missing interface not reported after Set")
+	}
+
+	mu.Lock()
+	gone = false
+	mu.Unlock()
+	health.RunChecks()
+	if err := health.TUNHealth(); err != nil {
+		t.Errorf("after interface returned: %v", err)
+	}
+
+	mu.Lock()
+	gone = true
+	mu.Unlock()
+	health.RunChecks()
+	if health.TUNHealth() == nil {
+		t.Error("periodic check didn't notice missing interface")
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := health.TUNHealth(); err != nil {
+		t.Errorf("after Close: %v", err)
+	}
+	health.RunChecks()
+	if err := health.TUNHealth(); err != nil {
+		t.Errorf("check still registered after Close: %v", err)
+	}
+}
+
+func TestTUNDown(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	var (
+		mu     sync.Mutex
+		checks int
+		up     bool
+	)
+	ifc.operUp = func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		checks++
+		return up
+	}
+	if err := r.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	health.RunChecks()
+	if err := health.TUNDownHealth(); err != nil {
+		t.Errorf("down link reported before any Config: %v", err)
+	}
+
+	cfg := &Config{LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")}}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	n := checks
+	mu.Unlock()
+	if n != 0 {
+		t.Errorf("link checked %d times during Set; want it left to the periodic check", n)
+	}
+	health.RunChecks()
+	if health.TUNDownHealth() == nil {
+		t.Fatal("down link not reported after Set")
+	}
+
+	// Tearing down doesn't leave a down link reported.
+	if err := r.Set(nil); err != nil {
+		t.Fatal(err)
+	}
+	health.RunChecks()
+	if err := health.TUNDownHealth(); err != nil {
+		t.Errorf("after shutdown Config: %v", err)
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	health.RunChecks()
+	if err := health.TUNDownHealth(); err != nil {
+		t.Errorf("after link came up: %v", err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	up = false
+	mu.Unlock()
+	health.RunChecks()
+	if err := health.TUNDownHealth(); err != nil {
+		t.Errorf("check still registered after Close: %v", err)
+	}
+}
+
+func TestDisableDNSRegistration(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	check := func(what string, disabled, restored int) {
+		t.Helper()
+		if ifc.regDisabled != disabled || ifc.regRestored != restored {
+			t.Errorf("%s: disabled %d, restored %d times; want %d, %d", what, ifc.regDisabled, ifc.regRestored, disabled, restored)
+		}
+	}
+
+	cfg := &Config{LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")}}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	check("option unset", 0, 0)
+
+	noReg := *cfg
+	noReg.DisableDNSRegistration = true
+	if err := r.Set(&noReg); err != nil {
+		t.Fatal(err)
+	}
+	noReg.Routes = []netaddr.IPPrefix{mustIPPrefix(t, "100.64.0.0/10")}
+	if err := r.Set(&noReg); err != nil {
+		t.Fatal(err)
+	}
+	check("option set", 1, 0)
+
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	check("option cleared", 1, 1)
+
+	if err := r.Set(&noReg); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check("Close", 2, 2)
+}
+
+func TestRouteConflict(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	ifc.subnets = []netaddr.IPPrefix{mustIPPrefix(t, "192.168.1.0/24"), mustIPPrefix(t, "2001:db8::/64")}
+	warning := health.RouteConflictWarning
+
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		Routes: []netaddr.IPPrefix{
+			mustIPPrefix(t, "100.64.0.0/10"),
+			mustIPPrefix(t, "0.0.0.0/0"),
+			mustIPPrefix(t, "10.0.0.0/8"),
+		},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := warning(); err != nil {
+		t.Errorf("without overlap: %v", err)
+	}
+
+	conflicting := *cfg
+	conflicting.Routes = append(cfg.Routes[:len(cfg.Routes):len(cfg.Routes)], mustIPPrefix(t, "192.168.1.128/25"))
+	if err := r.Set(&conflicting); err != nil {
+		t.Fatalf("Set with a conflicting route failed: %v", err)
+	}
+	if ifc.configured != 2 {
+		t.Errorf("interface configured %d times; want 2", ifc.configured)
+	}
+	err := warning()
+	if err == nil {
+		t.Fatal("overlapping route not reported")
+	}
+	if sev := health.SeverityOf("route-conflict"); sev != health.SeverityWarning {
+		t.Errorf("severity = %v; want %v", sev, health.SeverityWarning)
+	}
+	if !strings.Contains(err.Error(), "192.168.1.128/25") || !strings.Contains(err.Error(), "192.168.1.0/24") {
+		t.Errorf("warning %q doesn't name the overlapping prefixes", err)
+	}
+
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := warning(); err != nil {
+		t.Errorf("after overlap was removed: %v", err)
+	}
+}
+
+func TestRouteConflicts(t *testing.T) {
+	p := func(s string) netaddr.IPPrefix { return mustIPPrefix(t, s) }
+	subnets := []netaddr.IPPrefix{p("192.168.1.0/24"), p("2001:db8::/64")}
+	tests := []struct {
+		route netaddr.IPPrefix
+		want  bool
+	}{
+		{p("192.168.1.0/24"), true},
+		{p("192.168.1.7/32"), true},
+		{p("192.168.0.0/16"), true},
+		{p("192.168.2.0/24"), false},
+		{p("2001:db8::/48"), true},
+		{p("2001:db9::/64"), false},
+		{p("0.0.0.0/0"), false},
+		{p("::/0"), false},
+	}
+	for _, tt := range tests {
+		got := len(routeConflicts([]netaddr.IPPrefix{tt.route}, subnets)) > 0
+		if got != tt.want {
+			t.Errorf("route %v: conflict = %v; want %v", tt.route, got, tt.want)
+		}
+	}
+}
+
+func TestIPv6Disabled(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	ifc.noIPv6 = true
+	var got *Config
+	ifc.configure = func(cfg *Config) error {
+		got = cfg
+		for _, p := range append(cfg.LocalAddrs, cfg.Routes...) {
+			if ifc.noIPv6 && p.IP.Is6() {
+				// What winipcfg does with IPv6 disabled.
+				return windows.ERROR_NOT_FOUND
+			}
+		}
+		return nil
+	}
+
+	v4 := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		Routes:     []netaddr.IPPrefix{mustIPPrefix(t, "100.64.0.0/10")},
+	}
+	if err := r.Set(v4); err != nil {
+		t.Fatal(err)
+	}
+	if err := health.IPv6DisabledHealth(); err != nil {
+		t.Errorf("IPv4-only config: %v", err)
+	}
+
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32"), mustIPPrefix(t, "fd7a:115c:a1e0::1/128")},
+		Routes:     []netaddr.IPPrefix{mustIPPrefix(t, "100.64.0.0/10"), mustIPPrefix(t, "fd7a:115c:a1e0::/48")},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatalf("Set with IPv6 disabled: %v", err)
+	}
+	if health.IPv6DisabledHealth() == nil {
+		t.Error("IPv6 being disabled not reported")
+	}
+	if !prefixesEqual(got.LocalAddrs, v4.LocalAddrs) || !prefixesEqual(got.Routes, v4.Routes) {
+		t.Errorf("configured %v, %v; want only the IPv4 parts %v, %v", got.LocalAddrs, got.Routes, v4.LocalAddrs, v4.Routes)
+	}
+	if len(cfg.LocalAddrs) != 2 || len(cfg.Routes) != 2 {
+		t.Errorf("caller's Config was modified: %+v", cfg)
+	}
+
+	ifc.noIPv6 = false
+	if err := r.ReapplyAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := health.IPv6DisabledHealth(); err != nil {
+		t.Errorf("after IPv6 was enabled: %v", err)
+	}
+	if len(got.LocalAddrs) != 2 || len(got.Routes) != 2 {
+		t.Errorf("after IPv6 was enabled, configured %v, %v; want all of %v, %v", got.LocalAddrs, got.Routes, cfg.LocalAddrs, cfg.Routes)
+	}
+}
+
+func prefixesEqual(a, b []netaddr.IPPrefix) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMagicDNSHealth(t *testing.T) {
+	r, _, _ := newTestRouter(t)
+	var (
+		mu     sync.Mutex
+		probed []string
+		fail   = true
+	)
+	r.probeDNS = func(server netaddr.IP, name string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		probed = append(probed, server.String()+" "+name)
+		if fail {
+			return errors.New("no answer")
+		}
+		return nil
+	}
+	if err := r.Up(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		DNS: dns.Config{
+			Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+			Domains:     []string{"foo.beta.tailscale.net"},
+			Proxied:     true,
+		},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	health.RunChecks()
+	if health.MagicDNSHealth() == nil {
+		t.Fatal("unanswered probe not reported")
+	}
+	mu.Lock()
+	if len(probed) != 1 || probed[0] != "100.100.100.100 foo.beta.tailscale.net" {
+		t.Errorf("probed %q", probed)
+	}
+	fail = false
+	mu.Unlock()
+	health.RunChecks()
+	if err := health.MagicDNSHealth(); err != nil {
+		t.Errorf("after probe succeeded: %v", err)
+	}
+
+	// Turning off MagicDNS clears the state and stops probing.
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	cfg2 := *cfg
+	cfg2.DNS = dns.Config{}
+	if err := r.Set(&cfg2); err != nil {
+		t.Fatal(err)
+	}
+	health.RunChecks()
+	if err := health.MagicDNSHealth(); err != nil {
+		t.Errorf("after disabling MagicDNS: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(probed) != 2 {
+		t.Errorf("probed %d times; want 2", len(probed))
+	}
+}
+
+func TestDNSUpstreamHealth(t *testing.T) {
+	r, _, _ := newTestRouter(t)
+	var (
+		mu          sync.Mutex
+		unreachable = map[string]bool{"8.8.8.8": true}
+	)
+	r.probeDNS = func(server netaddr.IP, _ string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if unreachable[server.String()] {
+			return errors.New("timeout")
+		}
+		return nil
+	}
+	if err := r.Up(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		DNS: dns.Config{
+			Nameservers: []netaddr.IP{netaddr.MustParseIP("1.1.1.1"), netaddr.MustParseIP("8.8.8.8")},
+		},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	health.RunChecks()
+	err := health.DNSUpstreamHealth()
+	if err == nil || err.Error() != "DNS servers not reachable: 8.8.8.8" {
+		t.Fatalf("DNSUpstreamHealth = %v; want 8.8.8.8 unreachable", err)
+	}
+	if sev := health.SeverityOf("dns-upstream"); sev != health.SeverityWarning {
+		t.Errorf("severity = %v; want %v", sev, health.SeverityWarning)
+	}
+
+	mu.Lock()
+	unreachable = nil
+	mu.Unlock()
+	health.RunChecks()
+	if err := health.DNSUpstreamHealth(); err != nil {
+		t.Errorf("after upstream became reachable: %v", err)
+	}
+}
+
+func TestPMTUBlackhole(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	ifc.mtu = 1500
+	target := netaddr.MustParseIP("192.0.2.1")
+	var pathMTU int // largest size that gets through, or 0 for none
+	var probes int
+	r.probePMTU = func(ip netaddr.IP, size int) error {
+		probes++
+		if ip != target {
+			t.Errorf("probed %v; want %v", ip, target)
+		}
+		if size > pathMTU {
+			return errors.New("request timed out")
+		}
+		return nil
+	}
+
+	pathMTU = 1400
+	if err := r.pmtuHealth(); err != nil || probes != 0 {
+		t.Errorf("without target: %v after %d probes; want nil after 0", err, probes)
+	}
+
+	r.pmtuTarget = target
+	pathMTU = 1500
+	if err := r.pmtuHealth(); err != nil {
+		t.Errorf("full-size path: %v", err)
+	}
+	pathMTU = 0
+	if err := r.pmtuHealth(); err != nil {
+		t.Errorf("nothing gets through: %v; want nil", err)
+	}
+
+	pathMTU = 1400
+	err := r.pmtuHealth()
+	if err == nil {
+		t.Fatal("no error for black hole")
+	}
+	want := "packets over 1398 bytes don't reach 192.0.2.1 though the default route's MTU is 1500; lower the default interface's MTU to 1398"
+	if err.Error() != want {
+		t.Errorf("error = %q; want %q", err, want)
+	}
+
+	ifc.mtu = 0
+	if err := r.pmtuHealth(); err != nil {
+		t.Errorf("without default route: %v", err)
+	}
+}
+
+func TestDebugDump(t *testing.T) {
+	r, _, _ := newTestRouter(t)
+	r.tunname = "Tailscale"
+	r.tunGUID = "{37217669-42DA-4657-A55B-0D995D328250}"
+
+	want := `tun: Tailscale guid={37217669-42DA-4657-A55B-0D995D328250}
+killswitch: not supported
+desired Tailscale-In: []
+applied Tailscale-In: unknown
+Tailscale-Process added: false
+firewall last applied: never
+config: none
+`
+	if got := r.DebugDump(); got != want {
+		t.Errorf("DebugDump before Set:\n%s\nwant:\n%s", got, want)
+	}
+
+	r.setLastConfig(&Config{
+		LocalAddrs:    []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")},
+		Routes:        []netaddr.IPPrefix{mustIPPrefix(t, "100.64.0.0/10")},
+		DNS:           dns.Config{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}, Domains: []string{"example.ts.net"}, Proxied: true},
+		SearchDomains: []string{"corp.example"},
+	})
+	r.setDNSProbes(r.lastCfg.DNS)
+	want = `tun: Tailscale guid={37217669-42DA-4657-A55B-0D995D328250}
+killswitch: not supported
+desired Tailscale-In: []
+applied Tailscale-In: unknown
+Tailscale-Process added: false
+firewall last applied: never
+config:
+  local addrs: [100.101.102.103/32]
+  routes: [100.64.0.0/10]
+  dns: nameservers=[100.100.100.100] domains=["example.ts.net"] proxied=true per-domain=false
+  search domains: ["corp.example"]
+magicdns probe: 100.100.100.100 for "example.ts.net"
+`
+	if got := r.DebugDump(); got != want {
+		t.Errorf("DebugDump after Set:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	r, dm, _ := newTestRouter(t)
+	netsh := new(fakeNetsh)
+	r.firewall.netsh = netsh.run
+
+	for i := 0; i < 2; i++ {
+		if err := r.Close(); err != nil {
+			t.Fatalf("Close #%d: %v", i+1, err)
+		}
+	}
+	waitKnown(t, r.firewall)
+	if dm.downs != 1 {
+		t.Errorf("dns brought down %d times; want 1", dm.downs)
+	}
+	if n := netsh.count(deleteRuleArgs("Tailscale-In")...); n != 1 {
+		t.Errorf("Tailscale-In rules deleted %d times; want 1", n)
+	}
+}
+
+func TestCloseClearsFirewallHealth(t *testing.T) {
+	r, _, _ := newTestRouter(t)
+	defer func(d time.Duration) { slowFirewallThreshold = d }(slowFirewallThreshold)
+	slowFirewallThreshold = 20 * time.Millisecond
+	r.firewall.netsh = func(...string) error {
+		time.Sleep(2 * slowFirewallThreshold)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	r.firewall.set([]string{"100.101.102.103/32"})
+	if _, err := r.firewall.waitIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+	health.SetFirewallProcessRuleWarning(errors.New("no executable"))
+	health.SetPermanent("firewall", errors.New("access denied"))
+	keys := []string{"firewall-slow", "firewall-process-rule", "firewall"}
+	for _, key := range keys {
+		if health.SeverityOf(key) == 0 {
+			t.Fatalf("%s not set before Close", key)
+		}
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The rule removal Close starts is slow too, but finishes after
+	// Close, so mustn't report it.
+	if _, err := r.firewall.waitIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if sev := health.SeverityOf(key); sev != 0 {
+			t.Errorf("%s severity after Close = %v; want cleared", key, sev)
+		}
+	}
+}
+
+func TestFirewallWaitKnown(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		fail = true
+	)
+	netsh := new(fakeNetsh)
+	ft := &firewallTweaker{
+		logf: logger.Discard,
+		netsh: func(args ...string) error {
+			netsh.run(args...)
+			mu.Lock()
+			defer mu.Unlock()
+			if fail && args[2] == "add" {
+				return errors.New("access denied")
+			}
+			return nil
+		},
+	}
+	ft.set([]string{"100.101.102.103/32"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ft.waitKnown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("waitKnown while failing = %v; want %v", err, context.DeadlineExceeded)
+	}
+	ft.mu.Lock()
+	applied := ft.lastAppliedOK
+	ft.mu.Unlock()
+	if !applied.IsZero() {
+		t.Errorf("lastAppliedOK while failing = %v; want zero", applied)
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	start := time.Now()
+	waitKnown(t, ft)
+	if n := netsh.count(inRuleArgs("100.101.102.103/32", "private")...); n == 0 {
+		t.Error("Tailscale-In rule never added")
+	}
+	ft.mu.Lock()
+	applied = ft.lastAppliedOK
+	ft.mu.Unlock()
+	if applied.Before(start) {
+		t.Errorf("lastAppliedOK = %v; want after %v", applied, start)
+	}
+
+	ft.clear()
+	waitKnown(t, ft)
+}
+
+func TestFirewallPanicRecovery(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		panicked bool
+	)
+	netsh := new(fakeNetsh)
+	ft := &firewallTweaker{
+		logf: logger.Discard,
+		netsh: func(args ...string) error {
+			mu.Lock()
+			first := !panicked
+			panicked = true
+			mu.Unlock()
+			if first {
+				panic("netsh exploded")
+			}
+			return netsh.run(args...)
+		},
+	}
+	ft.set([]string{"100.101.102.103/32"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := ft.waitIdle(ctx); err != nil {
+		t.Fatalf("netsh goroutine still marked running after panic: %v", err)
+	}
+
+	ft.set([]string{"100.101.102.104/32"})
+	waitKnown(t, ft)
+	// The first run's rules are unknown, so they must be redone
+	// from scratch.
+	if n := netsh.count(deleteRuleArgs("Tailscale-In")...); n != 1 {
+		t.Errorf("Tailscale-In rules cleared %d times after panic; want 1", n)
+	}
+	if n := netsh.count(inRuleArgs("100.101.102.104/32", "private")...); n != 1 {
+		t.Errorf("Tailscale-In rule for new value added %d times; want 1", n)
+	}
+}
+
+func TestFirewallMinimalUpdate(t *testing.T) {
+	const (
+		a = "100.101.102.103/32"
+		b = "100.101.102.104/32"
+		c = "100.101.102.105/32"
+	)
+	netsh := new(fakeNetsh)
+	ft := &firewallTweaker{logf: logger.Discard, netsh: netsh.run}
+	ft.set([]string{a, b})
+	waitKnown(t, ft)
+	if n := netsh.count(deleteRuleArgs("Tailscale-In")...); n != 1 {
+		t.Errorf("initial set cleared Tailscale-In rules %d times; want 1", n)
+	}
+
+	check := func(what string, want ...[]string) {
+		t.Helper()
+		netsh.mu.Lock()
+		got := netsh.cmds
+		netsh.cmds = nil
+		netsh.mu.Unlock()
+		if len(got) != len(want) {
+			t.Fatalf("%s: netsh ran %q; want %q", what, got, want)
+		}
+		for i := range want {
+			if !strsEqual(got[i], want[i]) {
+				t.Errorf("%s: netsh command %d = %q; want %q", what, i, got[i], want[i])
+			}
+		}
+	}
+	netsh.mu.Lock()
+	netsh.cmds = nil
+	netsh.mu.Unlock()
+
+	ft.set([]string{a, c})
+	waitKnown(t, ft)
+	check("{a,b} to {a,c}", deleteInRuleArgs(b), inRuleArgs(c, "private"))
+
+	ft.clear()
+	waitKnown(t, ft)
+	check("clear", deleteRuleArgs("Tailscale-In"))
+}
+
+func TestCIDRsDiff(t *testing.T) {
+	tests := []struct {
+		old, new []string
+		add, del []string
+	}{
+		{old: nil, new: []string{"a"}, add: []string{"a"}},
+		{old: []string{"a"}, new: nil, del: []string{"a"}},
+		{old: []string{"a", "b"}, new: []string{"a", "c"}, add: []string{"c"}, del: []string{"b"}},
+		{old: []string{"a", "b"}, new: []string{"b", "a"}},
+	}
+	for _, tt := range tests {
+		add, del := cidrsDiff(tt.old, tt.new)
+		if !strsEqual(add, tt.add) || !strsEqual(del, tt.del) {
+			t.Errorf("cidrsDiff(%q, %q) = %q, %q; want %q, %q", tt.old, tt.new, add, del, tt.add, tt.del)
+		}
+	}
+}
+
+func TestFirewallProcPorts(t *testing.T) {
+	const exe = `C:\tailscaled.exe`
+	netsh := new(fakeNetsh)
+	ft := &firewallTweaker{
+		logf:              logger.Discard,
+		netsh:             netsh.run,
+		executable:        func() (string, error) { return exe, nil },
+		restrictProcPorts: true,
+	}
+	procRule := procRuleArgs(exe, nil)[:3] // "add rule name=Tailscale-Process"
+
+	ft.set([]string{"100.101.102.103/32"})
+	waitKnown(t, ft)
+	if n := netsh.count(procRule...); n != 0 {
+		t.Errorf("Tailscale-Process rule added %d times before ports known; want 0", n)
+	}
+
+	ft.setProcPorts([]uint16{41641})
+	waitKnown(t, ft)
+	if n := netsh.count(procRuleArgs(exe, []uint16{41641})...); n != 1 {
+		t.Errorf("rule for port 41641 added %d times; want 1", n)
+	}
+
+	ft.setProcPorts([]uint16{41641})
+	ft.setProcPorts([]uint16{12345})
+	waitKnown(t, ft)
+	if n := netsh.count(procRule...); n != 2 {
+		t.Errorf("Tailscale-Process rule added %d times; want 2", n)
+	}
+	if n := netsh.count(procRuleArgs(exe, []uint16{12345})...); n != 1 {
+		t.Errorf("rule for port 12345 added %d times; want 1", n)
+	}
+	if n := netsh.count(inRuleArgs("100.101.102.103/32", "private")...); n != 1 {
+		t.Errorf("Tailscale-In rule added %d times; want 1", n)
+	}
+
+	// Without the option, ports are ignored.
+	broad := &firewallTweaker{logf: logger.Discard, netsh: netsh.run, executable: ft.executable}
+	broad.setProcPorts([]uint16{41641})
+	if broad.running || broad.procPorts != nil {
+		t.Error("setProcPorts had an effect without restrictProcPorts")
+	}
+}
+
+func TestSetListenPorts(t *testing.T) {
+	const exe = `C:\tailscaled.exe`
+	r, _, _ := newTestRouter(t)
+	netsh := new(fakeNetsh)
+	r.firewall = &firewallTweaker{
+		logf:              logger.Discard,
+		netsh:             netsh.run,
+		executable:        func() (string, error) { return exe, nil },
+		restrictProcPorts: true,
+	}
+	cfg := &Config{LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")}}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	SetListenPorts(r, 41641)
+	waitKnown(t, r.firewall)
+	if n := netsh.count(procRuleArgs(exe, []uint16{41641})...); n != 1 {
+		t.Errorf("rule for port 41641 added %d times; want 1", n)
+	}
+
+	// A rebind moves magicsock to another port.
+	SetListenPorts(r, 50123)
+	waitKnown(t, r.firewall)
+	if n := netsh.count(procRuleArgs(exe, []uint16{50123})...); n != 1 {
+		t.Errorf("rule for port 50123 added %d times; want 1", n)
+	}
+	// Each new rule replaces the previous one.
+	if n := netsh.count(deleteRuleArgs("Tailscale-Process")...); n != 2 {
+		t.Errorf("Tailscale-Process rule deleted %d times; want 2", n)
+	}
+}
+
+func TestFirewallPermanentFailure(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		fail = true
+	)
+	ft := &firewallTweaker{
+		logf: logger.Discard,
+		netsh: func(args ...string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if fail && args[2] == "add" {
+				return errors.New("access denied")
+			}
+			return nil
+		},
+	}
+	ft.set([]string{"100.101.102.103/32"})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for health.SeverityOf("firewall") != health.SeverityPermanent {
+		if time.Now().After(deadline) {
+			t.Fatal("firewall failure never reported as permanent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	waitKnown(t, ft)
+	if sev := health.SeverityOf("firewall"); sev != 0 {
+		t.Errorf("firewall severity after recovery = %v; want healthy", sev)
+	}
+	ft.clear()
+	waitKnown(t, ft)
+}
+
+func TestFirewallPermanentFailureThenPanic(t *testing.T) {
+	defer health.Reset()
+	var (
+		mu   sync.Mutex
+		mode = "fail" // or "panic" or "ok"
+	)
+	ft := &firewallTweaker{
+		logf:       logger.Discard,
+		maxBackoff: 10 * time.Millisecond,
+		netsh: func(args ...string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			switch mode {
+			case "fail":
+				if args[2] == "add" {
+					return errors.New("access denied")
+				}
+			case "panic":
+				mode = "ok"
+				panic("netsh exploded")
+			}
+			return nil
+		},
+	}
+	ft.set([]string{"100.101.102.103/32"})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for health.SeverityOf("firewall") != health.SeverityPermanent {
+		if time.Now().After(deadline) {
+			t.Fatal("firewall failure never reported as permanent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	mode = "panic"
+	mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := ft.waitIdle(ctx); err != nil {
+		t.Fatalf("netsh goroutine still marked running after panic: %v", err)
+	}
+
+	// The next run, started here rather than by the panic retry,
+	// succeeds.
+	ft.set([]string{"100.101.102.103/32"})
+	waitKnown(t, ft)
+	if sev := health.SeverityOf("firewall"); sev != 0 {
+		t.Errorf("firewall severity after recovery = %v; want healthy", sev)
+	}
+	ft.clear()
+	waitKnown(t, ft)
+}
+
+func TestFirewallExecutableFailure(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	netsh := new(fakeNetsh)
+	ft := &firewallTweaker{
+		logf:  logger.Discard,
+		netsh: netsh.run,
+		executable: func() (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			return "", errors.New("no executable")
+		},
+	}
+
+	for _, cidr := range []string{"100.101.102.103/32", "100.101.102.104/32", "100.101.102.105/32"} {
+		ft.set([]string{cidr})
+		waitKnown(t, ft)
+	}
+	mu.Lock()
+	if calls != 1 {
+		t.Errorf("os.Executable called %d times; want 1 within the retry delay", calls)
+	}
+	mu.Unlock()
+	if n := netsh.count(inRuleArgs("100.101.102.105/32", "private")...); n != 1 {
+		t.Errorf("Tailscale-In rule added %d times; want 1", n)
+	}
+	if n := netsh.count("add", "rule", "name=Tailscale-Process"); n != 0 {
+		t.Errorf("Tailscale-Process rule added %d times; want 0", n)
+	}
+	ft.clear()
+	waitKnown(t, ft)
+}
+
+func TestProcRuleRetryDelay(t *testing.T) {
+	for _, tt := range []struct {
+		fails int
+		want  time.Duration
+	}{
+		{1, time.Second},
+		{2, 4 * time.Second},
+		{10, 100 * time.Second},
+		{100, 5 * time.Minute},
+	} {
+		if got := procRuleRetryDelay(tt.fails); got != tt.want {
+			t.Errorf("procRuleRetryDelay(%d) = %v; want %v", tt.fails, got, tt.want)
+		}
+	}
+}
+
+func TestFirewallSlow(t *testing.T) {
+	r, _, _ := newTestRouter(t)
+	defer func(d time.Duration) { slowFirewallThreshold = d }(slowFirewallThreshold)
+	slowFirewallThreshold = 20 * time.Millisecond
+
+	var (
+		mu   sync.Mutex
+		slow = true
+	)
+	// Only the first call of a pass is slow; the quick ones after it
+	// mustn't clear the warning.
+	r.firewall.netsh = func(args ...string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if slow {
+			slow = false
+			time.Sleep(2 * slowFirewallThreshold)
+		}
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	r.firewall.set([]string{"100.101.102.103/32", "fd7a:115c:a1e0::1/128"})
+	if _, err := r.firewall.waitIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sev := health.SeverityOf("firewall-slow"); sev != health.SeverityWarning {
+		t.Fatalf("severity after slow pass = %v; want %v", sev, health.SeverityWarning)
+	}
+
+	r.firewall.set([]string{"100.101.102.103/32"})
+	if _, err := r.firewall.waitIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sev := health.SeverityOf("firewall-slow"); sev != 0 {
+		t.Errorf("severity after fast pass = %v; want cleared", sev)
+	}
+}
+
+func TestFirewallDebug(t *testing.T) {
+	r, _, _ := newTestRouter(t)
+	r.firewall.set([]string{"100.101.102.103/32"})
+	waitKnown(t, r.firewall)
+	if r.FirewallLastApplied().IsZero() {
+		t.Error("FirewallLastApplied is zero after rules applied")
+	}
+	r.queryFirewall = func(names ...string) ([]installedFirewallRule, error) {
+		return []installedFirewallRule{
+			{Name: "Tailscale-Process", Enabled: true, Application: `C:\tailscaled.exe`},
+			{Name: "Tailscale-In", Enabled: true, LocalAddresses: "100.101.102.103/255.255.255.255"},
+		}, nil
+	}
+
+	got := r.FirewallDebug()
+	want := `desired Tailscale-In: ["100.101.102.103/32"]
+applied Tailscale-In: ["100.101.102.103/32"]
+Tailscale-Process added: true
+killswitch: not supported
+installed rules: 2
+  Tailscale-In enabled=true localip=100.101.102.103/255.255.255.255
+  Tailscale-Process enabled=true program=C:\tailscaled.exe
+`
+	if got != want {
+		t.Errorf("FirewallDebug:\n%s\nwant:\n%s", got, want)
+	}
+
+	r.queryFirewall = func(names ...string) ([]installedFirewallRule, error) {
+		return nil, errors.New("access denied")
+	}
+	if got := r.FirewallDebug(); !strings.HasSuffix(got, "installed rules: error: access denied\n") {
+		t.Errorf("FirewallDebug with failing query = %q", got)
+	}
+}
+
+func TestParsePositiveDuration(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"5m", 5 * time.Minute, false},
+		{"250ms", 250 * time.Millisecond, false},
+		{"0s", 0, true},
+		{"-1s", 0, true},
+		{"soon", 0, true},
+	} {
+		got, err := parsePositiveDuration(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parsePositiveDuration(%q) = %v, %v; want %v, err=%v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestWaitForRules(t *testing.T) {
+	r, _, _ := newTestRouter(t)
+	cfg := &Config{LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.103/32")}}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	got, err := WaitForRules(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"100.101.102.103/32"}; !strsEqual(got, want) {
+		t.Errorf("rules = %q; want %q", got, want)
+	}
+	r.firewall.mu.Lock()
+	running := r.firewall.running
+	r.firewall.mu.Unlock()
+	if running {
+		t.Error("firewall goroutine still running after WaitForRules")
+	}
+}
+
+func TestFirewallRuleLeak(t *testing.T) {
+	r, _, _ := newTestRouter(t)
+	var (
+		mu        sync.Mutex
+		installed = 1
+	)
+	r.queryFirewall = func(names ...string) ([]installedFirewallRule, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		var rules []installedFirewallRule
+		for i := 0; i < installed; i++ {
+			rules = append(rules, installedFirewallRule{Name: "Tailscale-In", Enabled: true})
+		}
+		return rules, nil
+	}
+	if err := r.Up(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	r.firewall.set([]string{"100.101.102.103/32"})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := r.firewall.waitIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+	health.RunChecks()
+	if sev := health.SeverityOf("firewall-rule-leak"); sev != 0 {
+		t.Fatalf("leak reported with one rule per CIDR (severity %v)", sev)
+	}
+
+	mu.Lock()
+	installed = 3
+	mu.Unlock()
+	health.RunChecks()
+	if sev := health.SeverityOf("firewall-rule-leak"); sev != health.SeverityWarning {
+		t.Errorf("severity with excess rules = %v; want %v", sev, health.SeverityWarning)
+	}
+}
+
+func TestFirewallProfileMismatch(t *testing.T) {
+	r, _, ifc := newTestRouter(t)
+	var (
+		mu       sync.Mutex
+		category int32 = categoryPrivate
+	)
+	ifc.category = func() int32 {
+		mu.Lock()
+		defer mu.Unlock()
+		return category
+	}
+	r.queryFirewall = func(names ...string) ([]installedFirewallRule, error) {
+		return []installedFirewallRule{
+			{Name: "Tailscale-In", Enabled: true, LocalAddresses: "100.101.102.103/255.255.255.255", Profiles: fwProfilePrivate},
+		}, nil
+	}
+	if err := r.Up(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	r.firewall.set([]string{"100.101.102.103/32"})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := r.firewall.waitIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+	health.RunChecks()
+	if sev := health.SeverityOf("firewall-profile-mismatch"); sev != 0 {
+		t.Fatalf("mismatch reported on private network (severity %v)", sev)
+	}
+
+	mu.Lock()
+	category = categoryPublic
+	mu.Unlock()
+	health.RunChecks()
+	if sev := health.SeverityOf("firewall-profile-mismatch"); sev != health.SeverityWarning {
+		t.Errorf("severity on public network = %v; want %v", sev, health.SeverityWarning)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sev := health.SeverityOf("firewall-profile-mismatch"); sev != 0 {
+		t.Errorf("severity after Close = %v; want cleared", sev)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	r, _, _ := newTestRouter(t)
+	want := RouterCapabilities{IPv6: true}
+	if got := Capabilities(r); got != want {
+		t.Errorf("Capabilities = %+v; want %+v", got, want)
+	}
+}
+
+func TestFirewallRuleArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{
+			name: "proc",
+			got:  procRuleArgs(`C:\Program Files\Tailscale\tailscaled.exe`, nil),
+			want: []string{"add", "rule", "name=Tailscale-Process", "dir=in", "action=allow", "edge=yes", `program=C:\Program Files\Tailscale\tailscaled.exe`, "protocol=udp", "profile=any", "enable=yes"},
+		},
+		{
+			name: "proc_ports",
+			got:  procRuleArgs(`C:\tailscaled.exe`, []uint16{41641, 41642}),
+			want: []string{"add", "rule", "name=Tailscale-Process", "dir=in", "action=allow", "edge=yes", `program=C:\tailscaled.exe`, "protocol=udp", "localport=41641,41642", "profile=any", "enable=yes"},
+		},
+		{
+			name: "in",
+			got:  inRuleArgs("100.101.102.103/32", "private"),
+			want: []string{"add", "rule", "name=Tailscale-In", "dir=in", "action=allow", "localip=100.101.102.103/32", "profile=private", "enable=yes"},
+		},
+		{
+			name: "delete",
+			got:  deleteRuleArgs("Tailscale-In"),
+			want: []string{"delete", "rule", "name=Tailscale-In", "dir=in"},
+		},
+		{
+			name: "delete_in",
+			got:  deleteInRuleArgs("100.101.102.103/32"),
+			want: []string{"delete", "rule", "name=Tailscale-In", "dir=in", "localip=100.101.102.103/32"},
+		},
+	}
+	for _, tt := range tests {
+		if !strsEqual(tt.got, tt.want) {
+			t.Errorf("%s: got %q; want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	r, dm, ifc := newTestRouter(t)
+	addr := mustIPPrefix(t, "100.101.102.103/32")
+	cfg := &Config{
+		LocalAddrs: []netaddr.IPPrefix{addr},
+		Routes:     []netaddr.IPPrefix{mustIPPrefix(t, "100.64.0.0/10"), mustIPPrefix(t, "10.0.0.0/8")},
+		DNS:        dns.Config{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.100")}},
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg = &Config{
+		LocalAddrs: []netaddr.IPPrefix{addr},
+		Routes:     []netaddr.IPPrefix{mustIPPrefix(t, "100.64.0.0/10"), mustIPPrefix(t, "192.168.0.0/24")},
+		DNS:        cfg.DNS,
+	}
+	if err := r.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ifc.configure = func(*Config) error { return errors.New("boom") }
+	if err := r.Set(&Config{LocalAddrs: []netaddr.IPPrefix{mustIPPrefix(t, "100.101.102.104/32")}}); err == nil {
+		t.Fatal("Set succeeded with failing Configure")
+	}
+	ifc.configure = nil
+	dm.failSet = errors.New("registry write failed")
+	cfg.DNS = dns.Config{Nameservers: []netaddr.IP{netaddr.MustParseIP("100.100.100.101")}}
+	if err := r.Set(cfg); err == nil {
+		t.Fatal("Set succeeded with failing DNS")
+	}
+	waitKnown(t, r.firewall)
+
+	got := Metrics(r)
+	if got.FirewallApplies == 0 || got.FirewallFailures != 0 {
+		t.Errorf("firewall applies, failures = %d, %d; want some, 0", got.FirewallApplies, got.FirewallFailures)
+	}
+	want := RouterMetrics{
+		Sets:              4,
+		SetFailures:       2,
+		RoutesAdded:       3,
+		RoutesRemoved:     1,
+		AddrsAdded:        1,
+		InterfaceFailures: 1,
+		DNSApplies:        2,
+		DNSFailures:       1,
+		FirewallApplies:   got.FirewallApplies,
+	}
+	if got != want {
+		t.Errorf("Metrics = %+v; want %+v", got, want)
+	}
+}
@@ -952,6 +952,9 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 		localAddrs[addr.IP] = true
 	}
 	e.localAddrs.Store(localAddrs)
+	// The port can change when magicsock rebinds; pass it along for
+	// routers whose firewall rules depend on it.
+	router.SetListenPorts(e.router, e.magicConn.LocalPort())
 
 	e.wgLock.Lock()
 	defer e.wgLock.Unlock()
@@ -1299,6 +1302,9 @@ func (e *userspaceEngine) LinkChange(isExpensive bool) {
 	if needRebind {
 		why = "link-change-major"
 		e.magicConn.Rebind()
+		// Rebinding can move us to a new port, so don't wait
+		// for the next Reconfig to tell the router.
+		router.SetListenPorts(e.router, e.magicConn.LocalPort())
 	}
 	e.magicConn.ReSTUN(why)
 	if linkChangeCallback != nil {